@@ -0,0 +1,320 @@
+package gitclone
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// localChange is a tracked path whose index or worktree differs from HEAD.
+type localChange struct {
+	path     string
+	staging  git.StatusCode
+	worktree git.StatusCode
+}
+
+// localChanges lists the uncommitted changes to tracked files. Untracked
+// files are left alone like git pull does.
+func localChanges(worktree *git.Worktree) ([]localChange, error) {
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []localChange
+	for path, fileStatus := range status {
+		if fileStatus.Staging == git.Untracked && fileStatus.Worktree == git.Untracked {
+			continue
+		}
+		if fileStatus.Staging == git.Unmodified && fileStatus.Worktree == git.Unmodified {
+			continue
+		}
+		changes = append(changes, localChange{
+			path:     path,
+			staging:  fileStatus.Staging,
+			worktree: fileStatus.Worktree,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+
+	return changes, nil
+}
+
+func dirtyWorktreeError(changes []localChange) error {
+	var message strings.Builder
+	message.WriteString("cannot pull with uncommitted changes; commit them or use --autostash")
+	for _, change := range changes {
+		fmt.Fprintf(&message, "\n\t%c%c %s", change.staging, change.worktree, change.path)
+	}
+
+	return &Error{
+		Code:    ExitFatal,
+		Message: message.String(),
+	}
+}
+
+// autostash records the local changes as a git stash commit (a worktree
+// commit whose parents are HEAD and an index commit), so they can be
+// reapplied after the pull or recovered with git stash apply.
+type autostash struct {
+	base   *object.Commit
+	commit *object.Commit
+}
+
+func createAutostash(repo *git.Repository, head *plumbing.Reference, changes []localChange, config *Config) (*autostash, error) {
+	base, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]treeEntry, len(idx.Entries))
+	for _, entry := range idx.Entries {
+		entries[entry.Name] = treeEntry{mode: entry.Mode, hash: entry.Hash}
+	}
+	indexTree, err := writeTree(repo.Storer, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	root := worktree.Filesystem.Root()
+	for _, change := range changes {
+		if change.worktree == git.Unmodified {
+			continue
+		}
+		if change.worktree == git.Deleted {
+			delete(entries, change.path)
+			continue
+		}
+
+		entry, err := worktreeEntry(repo, filepath.Join(root, filepath.FromSlash(change.path)))
+		if err != nil {
+			return nil, err
+		}
+		entries[change.path] = entry
+	}
+	worktreeTree, err := writeTree(repo.Storer, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	author, committer := pullSignatures(config)
+	branch := head.Name().Short()
+	if head.Name() == plumbing.HEAD {
+		branch = "(no branch)"
+	}
+	description := fmt.Sprintf("%s: %s %s", branch, base.Hash.String()[:7], commitSubject(base))
+	indexCommit, err := writeCommit(repo, &object.Commit{
+		Author:       author,
+		Committer:    committer,
+		Message:      "index on " + description + "\n",
+		TreeHash:     indexTree,
+		ParentHashes: []plumbing.Hash{base.Hash},
+	})
+	if err != nil {
+		return nil, err
+	}
+	stashCommit, err := writeCommit(repo, &object.Commit{
+		Author:       author,
+		Committer:    committer,
+		Message:      "WIP on " + description + "\n",
+		TreeHash:     worktreeTree,
+		ParentHashes: []plumbing.Hash{base.Hash, indexCommit},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := repo.CommitObject(stashCommit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &autostash{base: base, commit: commit}, nil
+}
+
+// apply merges the stashed changes into the freshly pulled worktree. On
+// conflicts nothing is written and the stash is stored in refs/stash.
+func (s *autostash) apply(repo *git.Repository, worktree *git.Worktree, head plumbing.Hash) error {
+	current, err := repo.CommitObject(head)
+	if err != nil {
+		return err
+	}
+
+	merged, conflicts, err := mergeCommitTrees(repo, s.base, current, s.commit)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		if err := storeStash(repo, s.commit); err != nil {
+			return err
+		}
+		return conflictError(
+			fmt.Sprintf("Applying autostash resulted in conflicts; your changes are safe in the stash (%s).", s.commit.Hash),
+			conflicts,
+		)
+	}
+
+	currentTree, err := current.Tree()
+	if err != nil {
+		return err
+	}
+	before, err := flattenTree(currentTree)
+	if err != nil {
+		return err
+	}
+	mergedTree, err := repo.TreeObject(merged)
+	if err != nil {
+		return err
+	}
+	after, err := flattenTree(mergedTree)
+	if err != nil {
+		return err
+	}
+
+	root := worktree.Filesystem.Root()
+	for path, entry := range after {
+		previous, tracked := before[path]
+		if tracked && previous == entry {
+			continue
+		}
+		if err := writeWorktreeEntry(repo, filepath.Join(root, filepath.FromSlash(path)), entry); err != nil {
+			return err
+		}
+		// Files added before the pull stay staged, as with git stash apply.
+		if !tracked {
+			if _, err := worktree.Add(path); err != nil {
+				return err
+			}
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			if err := os.Remove(filepath.Join(root, filepath.FromSlash(path))); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func worktreeEntry(repo *git.Repository, path string) (treeEntry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return treeEntry{}, err
+	}
+
+	mode := filemode.Regular
+	var content []byte
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return treeEntry{}, err
+		}
+		mode, content = filemode.Symlink, []byte(target)
+	default:
+		if info.Mode()&0o111 != 0 {
+			mode = filemode.Executable
+		}
+		if content, err = os.ReadFile(path); err != nil {
+			return treeEntry{}, err
+		}
+	}
+
+	hash, err := writeBlob(repo.Storer, content)
+	if err != nil {
+		return treeEntry{}, err
+	}
+
+	return treeEntry{mode: mode, hash: hash}, nil
+}
+
+func writeWorktreeEntry(repo *git.Repository, path string, entry treeEntry) error {
+	if entry.mode == filemode.Submodule {
+		return nil
+	}
+
+	content, err := readBlob(repo, entry.hash)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if entry.mode == filemode.Symlink {
+		return os.Symlink(string(content), path)
+	}
+
+	perm := os.FileMode(0o644)
+	if entry.mode == filemode.Executable {
+		perm = 0o755
+	}
+
+	return os.WriteFile(path, content, perm)
+}
+
+// storeStash does what git stash store does: point refs/stash at commit and
+// append a reflog entry so earlier stashes stay reachable as stash@{n}.
+func storeStash(repo *git.Repository, commit *object.Commit) error {
+	previous := plumbing.ZeroHash
+	ref, err := repo.Reference(plumbing.ReferenceName("refs/stash"), false)
+	switch {
+	case err == nil:
+		previous = ref.Hash()
+	case !errors.Is(err, plumbing.ErrReferenceNotFound):
+		return err
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/stash", commit.Hash)); err != nil {
+		return err
+	}
+
+	// The git directory is not necessarily <worktree>/.git: submodules and
+	// linked worktrees have a .git file pointing elsewhere.
+	storage, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return nil
+	}
+	logPath := path.Join("logs", "refs", "stash")
+	if err := storage.Filesystem().MkdirAll(path.Dir(logPath), 0o755); err != nil {
+		return err
+	}
+	logFile, err := storage.Filesystem().OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	committer := commit.Committer
+	_, err = fmt.Fprintf(logFile, "%s %s %s <%s> %d %s\t%s\n",
+		previous, commit.Hash, committer.Name, committer.Email,
+		committer.When.Unix(), committer.When.Format("-0700"), strings.TrimSpace(commit.Message))
+	if closeErr := logFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
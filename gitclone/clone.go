@@ -0,0 +1,640 @@
+package gitclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	formatcfg "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/kevinburke/ssh_config"
+)
+
+func executeClone(ctx context.Context, opts Options, destination string, stderr *output) (*git.Repository, Action, error) {
+	stderr.traces.general.printf("trace: clone: %s into '%s'", ScrubURL(opts.Repository), destination)
+	stderr.stats.begin(destination)
+	if err := resolveLowSpeed(&opts); err != nil {
+		return nil, 0, err
+	}
+	auth, err := buildAuthMethod(opts.fetchURL(), opts.Identity)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	auth, release, err := sessionTransports(opts, auth, stderr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	if opts.Pull {
+		return cloneOrPull(ctx, opts, destination, auth, stderr)
+	}
+
+	if err := validateCloneDestination(destination); err != nil {
+		return nil, 0, err
+	}
+
+	repo, err := cloneRepository(ctx, opts, destination, auth, stderr)
+	return repo, ActionCloned, err
+}
+
+func cloneOrPull(
+	ctx context.Context,
+	opts Options,
+	destination string,
+	auth transport.AuthMethod,
+	stderr *output,
+) (*git.Repository, Action, error) {
+	status, err := inspectDestination(destination)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !status.exists || status.emptyDir {
+		// go-git clones by depth only, so there is nothing these options
+		// could mean for a fresh clone.
+		if opts.deepenRequested() {
+			return nil, 0, &Error{
+				Code:    ExitUsage,
+				Message: fmt.Sprintf("%s needs an existing shallow clone at '%s'; use --depth for a new one", opts.deepenOption(), destination),
+			}
+		}
+		repo, err := cloneRepository(ctx, opts, destination, auth, stderr)
+		return repo, ActionCloned, err
+	}
+
+	repo, err := git.PlainOpen(destination)
+	if err != nil {
+		return nil, 0, destinationExistsError(destination)
+	}
+
+	if err := verifyRemote(repo, opts, stderr); err != nil {
+		return nil, 0, err
+	}
+
+	stopWatching := watchTransfer(opts, stderr)
+	defer stopWatching()
+
+	if opts.deepenRequested() {
+		err := withRetries(ctx, opts, stderr, "deepen", func() error {
+			return deepenHistory(ctx, repo, opts, auth, stderr)
+		}, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if _, err := repo.Worktree(); errors.Is(err, git.ErrIsBareRepository) {
+		updated, err := pullBare(ctx, repo, opts, auth, stderr)
+		stopWatching()
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := applyConfigEntries(repo, opts.ConfigEntries, stderr); err != nil {
+			return nil, 0, err
+		}
+		return repo, pullAction(updated), nil
+	}
+
+	before := plumbing.ZeroHash
+	if head, err := repo.Head(); err == nil {
+		before = head.Hash()
+	}
+
+	updated, err := pullCheckout(ctx, repo, opts, auth, stderr)
+	stopWatching()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if updated {
+		if err := reportHead(stderr, "checkout", repo); err != nil {
+			return nil, 0, err
+		}
+	}
+	if updated && !opts.Quiet {
+		head, err := repo.Head()
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := warnOrphanedSubmodules(repo, before, head.Hash(), "", stderr); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Submodules are brought in line even when the superproject did not
+	// move, so that a pull also repairs an earlier interrupted update.
+	if opts.RecurseSubmodules {
+		endTrace := stderr.phase("submodules")
+		err := updateSubmodules(ctx, repo, opts, auth, git.DefaultSubmoduleRecursionDepth, "", stderr)
+		endTrace()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if err := applyConfigEntries(repo, opts.ConfigEntries, stderr); err != nil {
+		return nil, 0, err
+	}
+
+	return repo, pullAction(updated), nil
+}
+
+func pullAction(updated bool) Action {
+	if updated {
+		return ActionPulled
+	}
+
+	return ActionUpToDate
+}
+
+func cloneRepository(
+	ctx context.Context,
+	opts Options,
+	destination string,
+	auth transport.AuthMethod,
+	stderr *output,
+) (repo *git.Repository, err error) {
+	status, err := inspectDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			removeClone(destination, status.exists)
+		}
+	}()
+
+	targetRef, err := resolveCloneReference(ctx, opts, auth, stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.RejectShallow {
+		if err := rejectShallowRemote(ctx, opts.fetchURL(), auth); err != nil {
+			return nil, err
+		}
+	}
+
+	if targetRef != "" {
+		reportRef(stderr, "ref", targetRef, plumbing.ZeroHash)
+	}
+
+	cloneOptions := &git.CloneOptions{
+		URL:               opts.fetchURL(),
+		RemoteName:        opts.RemoteName,
+		ReferenceName:     targetRef,
+		SingleBranch:      opts.SingleBranch,
+		Mirror:            opts.Mirror,
+		NoCheckout:        true,
+		Depth:             opts.Depth,
+		RecurseSubmodules: git.NoRecurseSubmodules,
+		ShallowSubmodules: opts.ShallowSubmodules,
+		Progress:          stderr.sideband(),
+		Tags:              opts.Tags,
+		Auth:              auth,
+		Shared:            opts.Shared,
+	}
+
+	// A failed attempt leaves a partial repository behind, which the next
+	// one could not clone into.
+	stopWatching := watchTransfer(opts, stderr)
+	err = withRetries(ctx, opts, stderr, "fetch", func() error {
+		endTrace := stderr.phase("fetch")
+		defer endTrace()
+		repo, err = git.PlainCloneContext(ctx, destination, opts.Bare, cloneOptions)
+		return err
+	}, func() {
+		removeClone(destination, status.exists)
+	})
+	stopWatching()
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		repo, err = initEmptyClone(opts, destination, stderr)
+	} else if err == nil {
+		err = finishClone(ctx, repo, opts, targetRef, stderr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.RecurseSubmodules && !opts.NoCheckout {
+		endTrace := stderr.phase("submodules")
+		err := updateSubmodules(ctx, repo, opts, auth, git.DefaultSubmoduleRecursionDepth, "", stderr)
+		endTrace()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.fetchURL() != opts.Repository {
+		if err := setRemoteURL(repo, opts.RemoteName, opts.Repository, stderr); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyConfigEntries(repo, opts.ConfigEntries, stderr); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// finishClone checks out the worktree, which the clone itself is told to
+// skip so that the checkout can report progress, and reports the default
+// branch a clone without -b resolved to and the commit it checked out.
+func finishClone(ctx context.Context, repo *git.Repository, opts Options, targetRef plumbing.ReferenceName, stderr *output) error {
+	if targetRef == "" {
+		if err := reportHead(stderr, "ref", repo); err != nil {
+			return err
+		}
+	}
+	if opts.NoCheckout || opts.Bare {
+		return nil
+	}
+	// The checkout does not watch ctx, so a cancellation during the fetch
+	// is noticed here at the latest.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := checkoutHead(repo, stderr); err != nil {
+		return err
+	}
+	return reportHead(stderr, "checkout", repo)
+}
+
+// initEmptyClone mirrors git for empty remotes: the repository is created on
+// init.defaultBranch with the remote and upstream branch configured.
+func initEmptyClone(opts Options, destination string, stderr io.Writer) (*git.Repository, error) {
+	defaultBranch, _ := opts.Config.Get("init", "", "defaultBranch")
+	if defaultBranch == "" {
+		defaultBranch = "master"
+	}
+	branchRef := plumbing.NewBranchReferenceName(defaultBranch)
+
+	repo, err := git.PlainInitWithOptions(destination, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: branchRef},
+		Bare:        opts.Bare,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	remoteConfig := &config.RemoteConfig{
+		Name: opts.RemoteName,
+		URLs: []string{opts.Repository},
+	}
+	if opts.Mirror {
+		remoteConfig.Mirror = true
+		remoteConfig.Fetch = []config.RefSpec{"+refs/*:refs/*"}
+	}
+	if _, err := repo.CreateRemote(remoteConfig); err != nil {
+		return nil, err
+	}
+
+	if !opts.Bare {
+		if err := repo.CreateBranch(&config.Branch{
+			Name:   defaultBranch,
+			Remote: opts.RemoteName,
+			Merge:  branchRef,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if !opts.Quiet {
+		fmt.Fprintln(stderr, "warning: You appear to have cloned an empty repository.")
+	}
+
+	return repo, nil
+}
+
+func resolveCloneReference(
+	ctx context.Context,
+	opts Options,
+	auth transport.AuthMethod,
+	stderr *output,
+) (plumbing.ReferenceName, error) {
+	branch := opts.Branch
+	if branch == "" {
+		return "", nil
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: opts.RemoteName,
+		URLs: []string{opts.fetchURL()},
+	})
+
+	var refs []*plumbing.Reference
+	err := withRetries(ctx, opts, stderr, "ls-remote", func() error {
+		endTrace := stderr.phase("ls-remote")
+		defer endTrace()
+		var err error
+		refs, err = remote.ListContext(ctx, &git.ListOptions{
+			Auth:          auth,
+			PeelingOption: git.AppendPeeled,
+		})
+		return err
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, ref := range refs {
+		stderr.traces.general.printf("trace: ref: %s", ref)
+	}
+
+	for _, candidate := range branchCandidates(branch) {
+		if hasRemoteReference(refs, candidate) {
+			return candidate, nil
+		}
+	}
+
+	for _, candidate := range tagCandidates(branch) {
+		if hasRemoteReference(refs, candidate) {
+			return candidate, nil
+		}
+	}
+
+	return "", &Error{
+		Code:    ExitFatal,
+		Message: fmt.Sprintf("Remote branch %s not found in upstream %s", branch, opts.RemoteName),
+	}
+}
+
+// rejectShallowRemote fails when the remote advertises shallow roots, which
+// is how upload-pack reveals that the source repository is itself shallow.
+func rejectShallowRemote(ctx context.Context, repository string, auth transport.AuthMethod) error {
+	endpoint, err := transport.NewEndpoint(repository)
+	if err != nil {
+		return err
+	}
+
+	transportClient, auth, err := sessionTransport(endpoint, auth)
+	if err != nil {
+		return err
+	}
+
+	session, err := transportClient.NewUploadPackSession(endpoint, auth)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	advertised, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			return nil
+		}
+		return err
+	}
+
+	if len(advertised.Shallows) > 0 {
+		return &Error{
+			Code:    ExitFatal,
+			Message: "source repository is shallow, reject to clone.",
+		}
+	}
+
+	return nil
+}
+
+func branchCandidates(branch string) []plumbing.ReferenceName {
+	if strings.HasPrefix(branch, "refs/heads/") {
+		return []plumbing.ReferenceName{plumbing.ReferenceName(branch)}
+	}
+
+	if strings.HasPrefix(branch, "refs/") {
+		return []plumbing.ReferenceName{plumbing.ReferenceName(branch)}
+	}
+
+	return []plumbing.ReferenceName{
+		plumbing.NewBranchReferenceName(branch),
+	}
+}
+
+func tagCandidates(branch string) []plumbing.ReferenceName {
+	if strings.HasPrefix(branch, "refs/tags/") {
+		return []plumbing.ReferenceName{plumbing.ReferenceName(branch)}
+	}
+
+	if strings.HasPrefix(branch, "refs/") {
+		return nil
+	}
+
+	return []plumbing.ReferenceName{plumbing.NewTagReferenceName(branch)}
+}
+
+func hasRemoteReference(refs []*plumbing.Reference, target plumbing.ReferenceName) bool {
+	for _, ref := range refs {
+		if ref.Name() == target {
+			return true
+		}
+	}
+
+	return false
+}
+
+func applyConfigEntries(repo *git.Repository, entries []ConfigEntry, stderr *output) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	defer stderr.phase("write config")()
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	if cfg.Raw == nil {
+		cfg.Raw = formatcfg.New()
+	}
+
+	for _, entry := range entries {
+		cfg.Raw.AddOption(entry.Section, entry.Subsection, entry.Key, entry.Value)
+	}
+
+	return repo.SetConfig(cfg)
+}
+
+// setRemoteURL records the repository as the user gave it in place of the
+// insteadOf rewrite the clone fetched from, as git does: the rules are
+// applied again on every fetch, and pushInsteadOf on every push.
+func setRemoteURL(repo *git.Repository, remoteName, url string, stderr *output) error {
+	defer stderr.phase("write config")()
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	remote, ok := cfg.Remotes[remoteName]
+	if !ok {
+		return nil
+	}
+
+	remote.URLs = []string{url}
+	return repo.SetConfig(cfg)
+}
+
+func buildAuthMethod(repository, identity string) (transport.AuthMethod, error) {
+	if identity == "" {
+		return nil, nil
+	}
+
+	endpoint, err := transport.NewEndpoint(repository)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Protocol != "ssh" {
+		return nil, &Error{
+			Code:    ExitFatal,
+			Message: "--identity is only supported for SSH remotes",
+		}
+	}
+
+	userName, err := sshUserForEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if looksLikePEM(identity) {
+		return gitssh.NewPublicKeys(userName, []byte(identity), "")
+	}
+
+	return gitssh.NewPublicKeysFromFile(userName, identity, "")
+}
+
+func looksLikePEM(value string) bool {
+	return strings.Contains(value, "BEGIN ") && strings.Contains(value, "PRIVATE KEY")
+}
+
+func sshUserForEndpoint(endpoint *transport.Endpoint) (string, error) {
+	if endpoint.User != "" {
+		return endpoint.User, nil
+	}
+
+	if endpoint.Host != "" {
+		if configured := ssh_config.DefaultUserSettings.Get(endpoint.Host, "User"); configured != "" {
+			return configured, nil
+		}
+	}
+
+	if current, err := user.Current(); err == nil && current.Username != "" {
+		return current.Username, nil
+	}
+
+	if envUser := os.Getenv("USER"); envUser != "" {
+		return envUser, nil
+	}
+
+	return "", &Error{
+		Code:    ExitFatal,
+		Message: "failed to determine SSH user for --identity",
+	}
+}
+
+type destinationStatus struct {
+	exists   bool
+	emptyDir bool
+}
+
+func inspectDestination(destination string) (destinationStatus, error) {
+	info, err := os.Stat(destination)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return destinationStatus{}, nil
+		}
+		return destinationStatus{}, err
+	}
+
+	status := destinationStatus{
+		exists: true,
+	}
+	if !info.IsDir() {
+		return status, nil
+	}
+
+	entries, err := os.ReadDir(destination)
+	if err != nil {
+		return destinationStatus{}, err
+	}
+	status.emptyDir = len(entries) == 0
+	return status, nil
+}
+
+func validateCloneDestination(destination string) error {
+	status, err := inspectDestination(destination)
+	if err != nil {
+		return err
+	}
+
+	if !status.exists || status.emptyDir {
+		return nil
+	}
+
+	return destinationExistsError(destination)
+}
+
+// removeClone undoes a clone into destination that failed or was
+// interrupted, like git does: a directory the clone created goes entirely,
+// one that already existed, empty, is emptied again.
+func removeClone(destination string, existed bool) {
+	if !existed {
+		_ = os.RemoveAll(destination)
+		return
+	}
+
+	entries, err := os.ReadDir(destination)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		_ = os.RemoveAll(filepath.Join(destination, entry.Name()))
+	}
+}
+
+func destinationExistsError(destination string) error {
+	return &Error{
+		Code:    ExitFatal,
+		Message: fmt.Sprintf("destination path '%s' already exists and is not an empty directory.", destination),
+	}
+}
+
+func checkoutBranch(repo *git.Repository, remoteName string, branchRef plumbing.ReferenceName) error {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	err = worktree.Checkout(&git.CheckoutOptions{Branch: branchRef})
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return err
+	}
+
+	remoteRef, remoteErr := repo.Reference(
+		plumbing.NewRemoteReferenceName(remoteName, branchRef.Short()),
+		true,
+	)
+	if remoteErr != nil {
+		return remoteErr
+	}
+
+	return worktree.Checkout(&git.CheckoutOptions{
+		Branch: branchRef,
+		Hash:   remoteRef.Hash(),
+		Create: true,
+	})
+}
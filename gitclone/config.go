@@ -0,0 +1,294 @@
+package gitclone
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigEntry is one configuration variable, section.subsection.key=value.
+type ConfigEntry struct {
+	Section    string
+	Subsection string
+	Key        string
+	Value      string
+}
+
+// Config is the effective configuration Clone consults while talking to
+// remotes. Entries are kept in precedence order, later ones win.
+type Config struct {
+	entries []ConfigEntry
+	// files, environment and commandLine are where LoadConfig found the
+	// entries and loadTime how long it took, for GIT_TRACE.
+	files       []string
+	environment int
+	commandLine int
+	loadTime    time.Duration
+}
+
+func newConfig(entries []ConfigEntry) *Config {
+	return &Config{entries: entries}
+}
+
+// CommandLine returns the configuration made of the entries LoadConfig was
+// given on the command line alone.
+func (c *Config) CommandLine() *Config {
+	if c == nil {
+		return nil
+	}
+
+	return newConfig(c.entries[len(c.entries)-c.commandLine:])
+}
+
+// Get returns the last value set for the key, matching section and key
+// case-insensitively and the subsection exactly, like git does.
+func (c *Config) Get(section, subsection, key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	for i := len(c.entries) - 1; i >= 0; i-- {
+		if c.entries[i].matches(section, subsection, key) {
+			return c.entries[i].Value, true
+		}
+	}
+
+	return "", false
+}
+
+// GetAll returns every value set for a multi-valued key in order.
+func (c *Config) GetAll(section, subsection, key string) []string {
+	if c == nil {
+		return nil
+	}
+
+	var values []string
+	for _, entry := range c.entries {
+		if entry.matches(section, subsection, key) {
+			values = append(values, entry.Value)
+		}
+	}
+
+	return values
+}
+
+func (c *Config) GetBool(section, subsection, key string, defaultValue bool) (bool, error) {
+	value, ok := c.Get(section, subsection, key)
+	if !ok {
+		return defaultValue, nil
+	}
+
+	parsed, valid := parseConfigBool(value)
+	if !valid {
+		return false, &Error{
+			Code:    ExitFatal,
+			Message: fmt.Sprintf("bad boolean config value '%s' for '%s'", value, configKeyName(section, subsection, key)),
+		}
+	}
+
+	return parsed, nil
+}
+
+func (c *Config) getInt(section, subsection, key string, defaultValue int) (int, error) {
+	value, ok := c.Get(section, subsection, key)
+	if !ok {
+		return defaultValue, nil
+	}
+
+	parsed, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, &Error{
+			Code:    ExitFatal,
+			Message: fmt.Sprintf("bad numeric config value '%s' for '%s'", value, configKeyName(section, subsection, key)),
+		}
+	}
+
+	return parsed, nil
+}
+
+func (e ConfigEntry) matches(section, subsection, key string) bool {
+	return strings.EqualFold(e.Section, section) &&
+		e.Subsection == subsection &&
+		strings.EqualFold(e.Key, key)
+}
+
+// ForURL returns the configuration as it applies to requests to rawURL:
+// http.<url>.<key> entries whose URL matches take the place of http.<key>,
+// the most specific match winning like in git. The URL matches when the
+// scheme, host and port are the same, with "*" standing for one host
+// label, its path is a prefix of the request path at a "/" boundary, and
+// a user name in it is the request's. A longer path is more specific, then
+// a match on the user name; between equals the later entry wins. Entries
+// for a key that are less specific than one seen before are ignored,
+// which leaves multi-valued keys such as extraHeader with the values of the
+// most specific entries and those that came first.
+func (c *Config) ForURL(rawURL string) *Config {
+	if c == nil {
+		return nil
+	}
+
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		target = nil
+	}
+
+	scoped := &Config{entries: make([]ConfigEntry, 0, len(c.entries))}
+	best := make(map[string]int)
+	for _, entry := range c.entries {
+		if !strings.EqualFold(entry.Section, "http") {
+			scoped.entries = append(scoped.entries, entry)
+			continue
+		}
+
+		specificity := 0
+		if entry.Subsection != "" {
+			var ok bool
+			if specificity, ok = urlMatch(entry.Subsection, target); !ok {
+				continue
+			}
+		}
+
+		key := strings.ToLower(entry.Key)
+		if previous, seen := best[key]; seen && specificity < previous {
+			continue
+		}
+		best[key] = specificity
+		entry.Subsection = ""
+		scoped.entries = append(scoped.entries, entry)
+	}
+
+	return scoped
+}
+
+// urlMatch tells whether the URL of an http.<url>.* entry matches target
+// and how specifically: above 0 for any match, growing with the length of
+// the matched path and then with a matched user name.
+func urlMatch(pattern string, target *url.URL) (int, bool) {
+	if target == nil {
+		return 0, false
+	}
+	scope, err := url.Parse(pattern)
+	if err != nil || scope.Host == "" || !strings.EqualFold(scope.Scheme, target.Scheme) {
+		return 0, false
+	}
+
+	userMatched := 0
+	if scope.User != nil {
+		if target.User == nil || scope.User.Username() != target.User.Username() {
+			return 0, false
+		}
+		userMatched = 1
+	}
+
+	if !hostMatches(scope.Hostname(), target.Hostname()) || urlPort(scope) != urlPort(target) {
+		return 0, false
+	}
+
+	scopePath := strings.TrimSuffix(scope.Path, "/")
+	if scopePath != "" && target.Path != scopePath && !strings.HasPrefix(target.Path, scopePath+"/") {
+		return 0, false
+	}
+
+	return 1 + 2*len(scopePath) + userMatched, true
+}
+
+func hostMatches(pattern, host string) bool {
+	patternLabels := strings.Split(pattern, ".")
+	hostLabels := strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i, label := range patternLabels {
+		if label != "*" && !strings.EqualFold(label, hostLabels[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+// SplitConfigKey splits section.key or section.subsection.key; the
+// subsection may itself contain dots.
+func SplitConfigKey(keyPath string) (string, string, string, bool) {
+	firstDot := strings.IndexByte(keyPath, '.')
+	if firstDot <= 0 || firstDot == len(keyPath)-1 {
+		return "", "", "", false
+	}
+
+	lastDot := strings.LastIndexByte(keyPath, '.')
+
+	// section.key (no subsection)
+	if firstDot == lastDot {
+		return keyPath[:firstDot], "", keyPath[firstDot+1:], true
+	}
+
+	// section.subsection.key
+	if lastDot == len(keyPath)-1 {
+		return "", "", "", false
+	}
+
+	return keyPath[:firstDot], keyPath[firstDot+1 : lastDot], keyPath[lastDot+1:], true
+}
+
+func parseConfigBool(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "yes", "on", "1":
+		return true, true
+	case "false", "no", "off", "0", "":
+		return false, true
+	}
+
+	return false, false
+}
+
+func configKeyName(section, subsection, key string) string {
+	if subsection == "" {
+		return strings.ToLower(section + "." + key)
+	}
+
+	return strings.ToLower(section) + "." + subsection + "." + strings.ToLower(key)
+}
+
+// FetchURL returns the URL git would fetch from for rawURL: the
+// url.<base>.insteadOf rules apply, and like git the longest matching prefix
+// wins across all of them.
+func (c *Config) FetchURL(rawURL string) string {
+	if c == nil {
+		return rawURL
+	}
+
+	var match, base string
+	for _, entry := range c.entries {
+		if !strings.EqualFold(entry.Section, "url") || !strings.EqualFold(entry.Key, "insteadOf") {
+			continue
+		}
+		if entry.Value == "" || !strings.HasPrefix(rawURL, entry.Value) {
+			continue
+		}
+		if len(entry.Value) > len(match) {
+			match, base = entry.Value, entry.Subsection
+		}
+	}
+
+	if match == "" {
+		return rawURL
+	}
+
+	return base + strings.TrimPrefix(rawURL, match)
+}
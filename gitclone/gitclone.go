@@ -0,0 +1,423 @@
+// Package gitclone clones and updates git repositories the way the
+// git-clone command does: it resolves the branch or tag to check out,
+// fetches over HTTP(S), SSH, git:// or the file system with the effective
+// git configuration applied, checks out the worktree and submodules, and
+// with Pull brings an existing clone up to date instead of failing.
+//
+// Clone runs everything and reports what it did in a Result. Errors carry
+// the exit code git would exit with, see Error.
+package gitclone
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// ExitFatal is the exit code git uses for fatal errors, which most Errors
+// returned by this package carry. ExitUsage is the one for options that do
+// not make sense, such as a missing Repository.
+const (
+	ExitFatal = 128
+	ExitUsage = 129
+)
+
+// Error is a failure git reports as "fatal: <Message>" before exiting with
+// Code. Other errors come from go-git or the operating system and are fatal
+// as well.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// PullMode selects how Pull reconciles local commits with the upstream.
+type PullMode int
+
+const (
+	PullFastForwardOnly PullMode = iota
+	PullMerge
+	PullRebase
+)
+
+// Options describe a clone. Only Repository is required; the zero value of
+// every other field is what git clone does without the matching option.
+type Options struct {
+	// Repository is the URL or path to clone from. It is recorded as the
+	// remote's URL as given, while the url.<base>.insteadOf rules of Config
+	// rewrite it for fetching and for naming the destination.
+	Repository string
+	// Directory is where the clone goes, see Destination when empty.
+	Directory string
+	// RemoteName names the remote, "origin" when empty.
+	RemoteName string
+	// Branch is the branch or tag to check out instead of the remote HEAD.
+	Branch string
+	// Identity is an SSH private key, as a file name or PEM data.
+	Identity string
+
+	Depth             int
+	Tags              git.TagMode
+	NoCheckout        bool
+	Bare              bool
+	Mirror            bool
+	Shared            bool
+	RejectShallow     bool
+	SingleBranch      bool
+	RecurseSubmodules bool
+	ShallowSubmodules bool
+	Quiet             bool
+	Verbose           bool
+
+	// Pull updates an existing clone at the destination instead of
+	// failing; the fields below only apply to it.
+	Pull              bool
+	PullMode          PullMode
+	PullNoFastForward bool
+	Autostash         bool
+	Reset             bool
+	Clean             bool
+	SetURL            bool
+	// Prune removes refs deleted upstream. Bare and mirror repositories
+	// prune unless NoPrune is set.
+	Prune        bool
+	NoPrune      bool
+	PruneTags    bool
+	Deepen       int
+	Unshallow    bool
+	ShallowSince time.Time
+
+	// Timeout bounds the whole run and ConnectTimeout each connection to
+	// the remote; zero waits as long as it takes. A fetch receiving less
+	// than LowSpeedLimit bytes a second for LowSpeedTime is aborted, with
+	// http.lowSpeedLimit and http.lowSpeedTime used when both are zero.
+	Timeout        time.Duration
+	ConnectTimeout time.Duration
+	LowSpeedLimit  int
+	LowSpeedTime   time.Duration
+	// Retries is how many times ls-remote, the fetch of a clone or pull,
+	// the deepening of a shallow history and submodule updates are tried
+	// again after a transient failure, such as an HTTP 429 or 5xx answer or
+	// a dropped connection.
+	Retries int
+
+	// ConfigEntries are written to the repository's config, like -c.
+	ConfigEntries []ConfigEntry
+	// Config is what Clone consults for http.*, core.sshCommand, proxies,
+	// init.defaultBranch, user identities and the like, see LoadConfig.
+	// A nil Config has no settings.
+	Config *Config
+
+	// Log receives the messages git prints on stderr. Nothing is written
+	// when it is nil.
+	Log io.Writer
+	// Progress receives progress when it is not nil.
+	Progress Progress
+	// Trace is where GIT_TRACE, GIT_TRACE_PACKET and GIT_CURL_VERBOSE
+	// write when they ask for stderr, Log when it is nil.
+	Trace io.Writer
+	// Stats collects the Stats of the run into the Result.
+	Stats bool
+}
+
+// Action is what a run did to the destination.
+type Action int
+
+const (
+	ActionCloned Action = iota
+	ActionPulled
+	ActionUpToDate
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionCloned:
+		return "cloned"
+	case ActionPulled:
+		return "pulled"
+	default:
+		return "up-to-date"
+	}
+}
+
+// Result describes a successful run. Ref is the branch HEAD points to, or
+// for a detached HEAD the tag at it, falling back to "HEAD"; Commit is zero
+// for an empty repository. Submodules counts the initialized submodules,
+// nested ones included, when RecurseSubmodules is set.
+type Result struct {
+	Repository  *git.Repository
+	Action      Action
+	Destination string
+	Ref         string
+	Commit      plumbing.Hash
+	Submodules  int
+	Stats       *Stats
+}
+
+// output is where a run reports to: the log, the progress sink, the
+// GIT_TRACE* outputs and the Stats collector. It writes to the log, so the
+// functions that only print take it as an io.Writer. It also keeps the
+// phases that are running, so that a timeout can say which one it hit.
+type output struct {
+	log      io.Writer
+	progress Progress
+	traces   traceOutputs
+	stats    *cloneStats
+
+	// cancel ends the run once timeOut recorded why in timedOut.
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	phases   []string
+	timedOut string
+
+	// received counts the bytes upload-pack responses delivered, see
+	// countTransports.
+	received atomic.Int64
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	return o.log.Write(p)
+}
+
+// phase times a phase of the run for GIT_TRACE and Stats once the returned
+// function is called.
+func (o *output) phase(name string) func() {
+	o.mu.Lock()
+	o.phases = append(o.phases, name)
+	o.mu.Unlock()
+
+	endTrace := o.traces.general.phase(name)
+	started := time.Now()
+	return func() {
+		endTrace()
+		o.stats.addPhase(name, time.Since(started))
+
+		o.mu.Lock()
+		o.phases = o.phases[:len(o.phases)-1]
+		o.mu.Unlock()
+	}
+}
+
+// sideband is what go-git writes the server's progress to, nil without a
+// progress sink.
+func (o *output) sideband() io.Writer {
+	if o.progress == nil {
+		return nil
+	}
+
+	return o.progress
+}
+
+// Clone clones opts.Repository, or with opts.Pull updates the clone already
+// at the destination. ctx bounds the network operations; when it is done
+// Clone returns ctx.Err(). A clone that fails or is canceled removes what
+// it created, while a repository that Pull updates is left as it is.
+func Clone(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Repository == "" {
+		return nil, &Error{Code: ExitUsage, Message: "You must specify a repository to clone."}
+	}
+	if opts.RemoteName == "" {
+		opts.RemoteName = git.DefaultRemoteName
+	}
+
+	stderr := &output{log: opts.Log, progress: opts.Progress}
+	if stderr.log == nil {
+		stderr.log = io.Discard
+	}
+	trace := opts.Trace
+	if trace == nil {
+		trace = stderr.log
+	}
+	stderr.traces = openTraces(trace)
+	defer stderr.traces.Close()
+	defer stderr.traces.general.phase("git-clone")()
+	if opts.Stats {
+		stderr.stats = &cloneStats{}
+	}
+	opts.Config.trace(stderr.traces.general)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stderr.cancel = cancel
+	stopTimeout := func() {}
+	if opts.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		runCtx, cancelTimeout = context.WithTimeoutCause(runCtx, opts.Timeout, errRunTimeout)
+		defer cancelTimeout()
+		stopTimeout = stderr.watchTimeout(runCtx, opts.Timeout)
+	}
+
+	started := time.Now()
+	destination := Destination(opts.fetchURL(), opts.Directory)
+	repo, action, err := executeClone(runCtx, opts, destination, stderr)
+	stopTimeout()
+	if err != nil {
+		if message := stderr.timeoutMessage(); message != "" {
+			return nil, &Error{Code: ExitFatal, Message: message}
+		}
+		// go-git reports a cancellation in its own words, if at all.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		var connectErr *connectTimeoutError
+		if errors.As(unwrapTransportError(err), &connectErr) {
+			return nil, &Error{Code: ExitFatal, Message: connectErr.message}
+		}
+		return nil, err
+	}
+
+	result := &Result{Repository: repo, Action: action, Destination: destination}
+	ref, commit, err := resolvedHead(repo)
+	if err != nil {
+		return nil, err
+	}
+	result.Ref, result.Commit = ref, commit
+	if opts.RecurseSubmodules {
+		if result.Submodules, err = countSubmodules(repo); err != nil {
+			return nil, err
+		}
+	}
+	if stderr.stats != nil {
+		if result.Stats, err = stderr.stats.report(repo, destination, started); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// fetchURL is Repository after the url.<base>.insteadOf rules of Config,
+// the URL git itself would fetch from.
+func (opts Options) fetchURL() string {
+	return opts.Config.FetchURL(opts.Repository)
+}
+
+// Destination is the directory a clone of repository goes to: directory
+// when it is set, otherwise the last path component of the repository
+// without ".git", like git clone.
+func Destination(repository, directory string) string {
+	if directory != "" {
+		return directory
+	}
+
+	endpoint, err := transport.NewEndpoint(repository)
+	if err == nil {
+		base := path.Base(endpoint.Path)
+		if base != "." && base != "/" && base != "" {
+			return strings.TrimSuffix(base, ".git")
+		}
+	}
+
+	repository = strings.TrimRight(repository, "/")
+	base := filepath.Base(repository)
+	return strings.TrimSuffix(base, ".git")
+}
+
+// resolvedHead names what is checked out: the branch HEAD points to, even
+// when it is unborn, or for a detached HEAD the tag at it, falling back to
+// HEAD itself.
+func resolvedHead(repo *git.Repository) (string, plumbing.Hash, error) {
+	head, err := repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	if head.Type() == plumbing.SymbolicReference {
+		resolved, err := repo.Reference(head.Target(), true)
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return head.Target().String(), plumbing.ZeroHash, nil
+		}
+		if err != nil {
+			return "", plumbing.ZeroHash, err
+		}
+		return head.Target().String(), resolved.Hash(), nil
+	}
+
+	tag, err := tagAtCommit(repo, head.Hash())
+	if err != nil {
+		var gitErr *Error
+		if errors.As(err, &gitErr) {
+			return plumbing.HEAD.String(), head.Hash(), nil
+		}
+		return "", plumbing.ZeroHash, err
+	}
+
+	return tag.String(), head.Hash(), nil
+}
+
+// countSubmodules counts the initialized submodules of repo, nested ones
+// included.
+func countSubmodules(repo *git.Repository) (int, error) {
+	worktree, err := repo.Worktree()
+	if errors.Is(err, git.ErrIsBareRepository) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	submodules, err := worktree.Submodules()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, submodule := range submodules {
+		if !isInitializedSubmodule(repo, submodule.Config().Name) {
+			continue
+		}
+		count++
+
+		submoduleRepo, err := submodule.Repository()
+		if err != nil {
+			return 0, err
+		}
+		nested, err := countSubmodules(submoduleRepo)
+		if err != nil {
+			return 0, err
+		}
+		count += nested
+	}
+
+	return count, nil
+}
+
+// ScrubURL removes credentials from a remote URL before it is reported.
+// HTTP tokens are often passed as the user name, so the whole user info
+// goes for HTTP(S); other schemes keep the user but lose any password. A
+// URL with a scheme that does not parse loses all of its user info, while
+// scp-like addresses, which carry no password, are kept as they are.
+func ScrubURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		if !strings.Contains(rawURL, "://") {
+			return rawURL
+		}
+		return dropUserInfo(rawURL)
+	}
+	if parsed.User == nil {
+		return rawURL
+	}
+
+	switch parsed.Scheme {
+	case "http", "https":
+		parsed.User = nil
+	default:
+		parsed.User = url.User(parsed.User.Username())
+	}
+
+	return parsed.String()
+}
@@ -0,0 +1,565 @@
+package gitclone
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxIncludeDepth = 10
+
+// configLoadContext carries what includeIf conditions are evaluated against.
+// git-clone loads configuration before the destination exists, so gitDir is
+// where the repository is going to be created, or where it already is when
+// --pull updates it.
+type configLoadContext struct {
+	gitDir     string
+	remoteURLs []string
+}
+
+// LoadConfig layers system, global, repository, GIT_CONFIG_COUNT and
+// commandLine entries in git's precedence order, expanding include and
+// includeIf as it goes. gitDir is the git directory the clone is going to
+// use, or already uses when it is pulled; its config is the repository
+// layer when it exists. includeIf "gitdir:" conditions match against it and
+// "hasconfig:remote.*.url:" conditions against remoteURL.
+func LoadConfig(gitDir, remoteURL string, commandLine []ConfigEntry) (*Config, error) {
+	started := time.Now()
+	loader := &configLoader{ctx: configLoadContext{gitDir: gitDir, remoteURLs: []string{remoteURL}}}
+
+	files := configFiles()
+	if gitDir != "" {
+		files = append(files, filepath.Join(gitDir, "config"))
+	}
+	for _, file := range files {
+		if err := loader.loadFile(file, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	environment, err := environmentConfigEntries()
+	if err != nil {
+		return nil, err
+	}
+	loader.entries = append(loader.entries, environment...)
+	loader.entries = append(loader.entries, commandLine...)
+
+	config := newConfig(loader.entries)
+	config.files = loader.files
+	config.environment = len(environment)
+	config.commandLine = len(commandLine)
+	config.loadTime = time.Since(started)
+	return config, nil
+}
+
+func configFiles() []string {
+	var files []string
+
+	noSystem, _ := parseConfigBool(os.Getenv("GIT_CONFIG_NOSYSTEM"))
+	if !noSystem {
+		if system := os.Getenv("GIT_CONFIG_SYSTEM"); system != "" {
+			files = append(files, system)
+		} else {
+			files = append(files, "/etc/gitconfig")
+		}
+	}
+
+	if global, ok := os.LookupEnv("GIT_CONFIG_GLOBAL"); ok {
+		if global != "" {
+			files = append(files, expandHome(global))
+		}
+		return files
+	}
+
+	home, _ := os.UserHomeDir()
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" && home != "" {
+		xdg = filepath.Join(home, ".config")
+	}
+	if xdg != "" {
+		files = append(files, filepath.Join(xdg, "git", "config"))
+	}
+	if home != "" {
+		files = append(files, filepath.Join(home, ".gitconfig"))
+	}
+
+	return files
+}
+
+// environmentConfigEntries reads GIT_CONFIG_COUNT, GIT_CONFIG_KEY_<n> and
+// GIT_CONFIG_VALUE_<n>.
+func environmentConfigEntries() ([]ConfigEntry, error) {
+	rawCount := os.Getenv("GIT_CONFIG_COUNT")
+	if rawCount == "" {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(rawCount)
+	if err != nil || count < 0 {
+		return nil, &Error{
+			Code:    ExitFatal,
+			Message: "bogus count in GIT_CONFIG_COUNT",
+		}
+	}
+
+	entries := make([]ConfigEntry, 0, count)
+	for i := 0; i < count; i++ {
+		keyName := fmt.Sprintf("GIT_CONFIG_KEY_%d", i)
+		keyPath, ok := os.LookupEnv(keyName)
+		if !ok || keyPath == "" {
+			return nil, &Error{
+				Code:    ExitFatal,
+				Message: fmt.Sprintf("missing config key %s", keyName),
+			}
+		}
+
+		valueName := fmt.Sprintf("GIT_CONFIG_VALUE_%d", i)
+		value, ok := os.LookupEnv(valueName)
+		if !ok {
+			return nil, &Error{
+				Code:    ExitFatal,
+				Message: fmt.Sprintf("missing config value %s", valueName),
+			}
+		}
+
+		section, subsection, key, ok := SplitConfigKey(keyPath)
+		if !ok {
+			return nil, &Error{
+				Code:    ExitFatal,
+				Message: fmt.Sprintf("invalid config key `%s`", keyPath),
+			}
+		}
+		entries = append(entries, ConfigEntry{
+			Section:    section,
+			Subsection: subsection,
+			Key:        key,
+			Value:      value,
+		})
+	}
+
+	return entries, nil
+}
+
+type configLoader struct {
+	ctx     configLoadContext
+	entries []ConfigEntry
+	// files are the files read, includes among them, for GIT_TRACE.
+	files []string
+}
+
+func (l *configLoader) loadFile(path string, depth int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			return nil
+		}
+		return err
+	}
+
+	entries, err := parseGitConfig(string(data), path)
+	if err != nil {
+		return err
+	}
+	l.files = append(l.files, path)
+
+	for _, entry := range entries {
+		l.entries = append(l.entries, entry)
+
+		includePath, ok := l.includePath(entry, path)
+		if !ok {
+			continue
+		}
+		if depth >= maxIncludeDepth {
+			return &Error{
+				Code:    ExitFatal,
+				Message: fmt.Sprintf("exceeded maximum include depth (%d) while including %s from %s", maxIncludeDepth, includePath, path),
+			}
+		}
+		if err := l.loadFile(includePath, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *configLoader) includePath(entry ConfigEntry, fromFile string) (string, bool) {
+	if !strings.EqualFold(entry.Key, "path") || entry.Value == "" {
+		return "", false
+	}
+
+	switch {
+	case strings.EqualFold(entry.Section, "include") && entry.Subsection == "":
+	case strings.EqualFold(entry.Section, "includeIf") && l.conditionMatches(entry.Subsection, fromFile):
+	default:
+		return "", false
+	}
+
+	includePath := expandHome(entry.Value)
+	if !filepath.IsAbs(includePath) {
+		includePath = filepath.Join(filepath.Dir(fromFile), includePath)
+	}
+
+	return includePath, true
+}
+
+func (l *configLoader) conditionMatches(condition, fromFile string) bool {
+	switch {
+	case strings.HasPrefix(condition, "gitdir:"):
+		return l.gitDirMatches(strings.TrimPrefix(condition, "gitdir:"), fromFile, false)
+	case strings.HasPrefix(condition, "gitdir/i:"):
+		return l.gitDirMatches(strings.TrimPrefix(condition, "gitdir/i:"), fromFile, true)
+	case strings.HasPrefix(condition, "hasconfig:remote.*.url:"):
+		return l.remoteURLMatches(strings.TrimPrefix(condition, "hasconfig:remote.*.url:"))
+	}
+
+	return false
+}
+
+func (l *configLoader) gitDirMatches(pattern, fromFile string, foldCase bool) bool {
+	if l.ctx.gitDir == "" || pattern == "" {
+		return false
+	}
+
+	// Expanding ~/ and ./ goes through filepath.Join, which drops the
+	// trailing slash that means "everything below".
+	trailingSlash := strings.HasSuffix(pattern, "/")
+	switch {
+	case strings.HasPrefix(pattern, "~/"):
+		pattern = filepath.ToSlash(expandHome(pattern))
+	case strings.HasPrefix(pattern, "./"):
+		pattern = filepath.ToSlash(filepath.Join(filepath.Dir(fromFile), pattern[2:]))
+	}
+	if trailingSlash && !strings.HasSuffix(pattern, "/") {
+		pattern += "/"
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+
+	return wildmatch(pattern, filepath.ToSlash(l.ctx.gitDir), foldCase)
+}
+
+func (l *configLoader) remoteURLMatches(pattern string) bool {
+	urls := append([]string(nil), l.ctx.remoteURLs...)
+	for _, entry := range l.entries {
+		if strings.EqualFold(entry.Section, "remote") && strings.EqualFold(entry.Key, "url") {
+			urls = append(urls, entry.Value)
+		}
+	}
+
+	for _, url := range urls {
+		if wildmatch(pattern, url, false) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wildmatch matches text against a git wildmatch pattern in pathname mode:
+// "*" and "?" stop at slashes while "**" crosses them.
+func wildmatch(pattern, text string, foldCase bool) bool {
+	var b strings.Builder
+	if foldCase {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return false
+	}
+
+	return re.MatchString(text)
+}
+
+// parseGitConfig parses the git config file format into entries in file
+// order, so that includes can be expanded exactly where they appear.
+func parseGitConfig(content, file string) ([]ConfigEntry, error) {
+	p := &gitConfigParser{src: content, file: file, line: 1}
+	return p.parse()
+}
+
+type gitConfigParser struct {
+	src  string
+	pos  int
+	line int
+	file string
+}
+
+func (p *gitConfigParser) parse() ([]ConfigEntry, error) {
+	var entries []ConfigEntry
+	section, subsection := "", ""
+
+	for {
+		p.skipWhitespace()
+		if p.eof() {
+			return entries, nil
+		}
+
+		switch c := p.peek(); {
+		case c == '#' || c == ';':
+			p.skipLine()
+		case c == '[':
+			var err error
+			if section, subsection, err = p.parseSectionHeader(); err != nil {
+				return nil, err
+			}
+		case isConfigKeyStart(c):
+			if section == "" {
+				return nil, p.errorf()
+			}
+			key := p.parseKey()
+			p.skipBlanks()
+
+			value := "true"
+			switch {
+			case p.eof() || p.peek() == '\n':
+			case p.peek() == '#' || p.peek() == ';':
+				p.skipLine()
+			case p.peek() == '=':
+				p.pos++
+				var err error
+				if value, err = p.parseValue(); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, p.errorf()
+			}
+
+			entries = append(entries, ConfigEntry{
+				Section:    section,
+				Subsection: subsection,
+				Key:        key,
+				Value:      value,
+			})
+		default:
+			return nil, p.errorf()
+		}
+	}
+}
+
+func (p *gitConfigParser) parseSectionHeader() (string, string, error) {
+	p.pos++
+	start := p.pos
+	for !p.eof() && (isConfigKeyChar(p.peek()) || p.peek() == '.') {
+		p.pos++
+	}
+	name := p.src[start:p.pos]
+	if name == "" {
+		return "", "", p.errorf()
+	}
+
+	if !p.eof() && p.peek() == ']' {
+		p.pos++
+		// Legacy [section.subsection] syntax lowercases the subsection.
+		if section, subsection, ok := strings.Cut(name, "."); ok {
+			return section, strings.ToLower(subsection), nil
+		}
+		return name, "", nil
+	}
+
+	p.skipBlanks()
+	if p.eof() || p.peek() != '"' {
+		return "", "", p.errorf()
+	}
+	p.pos++
+
+	var subsection strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", "", p.errorf()
+		}
+		c := p.src[p.pos]
+		p.pos++
+		if c == '"' {
+			break
+		}
+		if c == '\\' {
+			if p.eof() || p.peek() == '\n' {
+				return "", "", p.errorf()
+			}
+			c = p.src[p.pos]
+			p.pos++
+		}
+		subsection.WriteByte(c)
+	}
+
+	if p.eof() || p.peek() != ']' {
+		return "", "", p.errorf()
+	}
+	p.pos++
+
+	return name, subsection.String(), nil
+}
+
+func (p *gitConfigParser) parseKey() string {
+	start := p.pos
+	for !p.eof() && isConfigKeyChar(p.peek()) {
+		p.pos++
+	}
+
+	return p.src[start:p.pos]
+}
+
+func (p *gitConfigParser) parseValue() (string, error) {
+	p.skipBlanks()
+
+	var value strings.Builder
+	var pending strings.Builder
+	quoted := false
+
+	for !p.eof() {
+		c := p.src[p.pos]
+		p.pos++
+
+		switch {
+		case c == '\n':
+			if quoted {
+				return "", p.errorf()
+			}
+			p.line++
+			return value.String(), nil
+		case !quoted && (c == '#' || c == ';'):
+			p.skipLine()
+			return value.String(), nil
+		case !quoted && (c == ' ' || c == '\t' || c == '\r'):
+			if value.Len() > 0 {
+				pending.WriteByte(c)
+			}
+		case c == '"':
+			quoted = !quoted
+			value.WriteString(pending.String())
+			pending.Reset()
+		case c == '\\':
+			if p.eof() {
+				return "", p.errorf()
+			}
+			escaped := p.src[p.pos]
+			p.pos++
+			value.WriteString(pending.String())
+			pending.Reset()
+			switch escaped {
+			case '\n':
+				p.line++
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'b':
+				value.WriteByte('\b')
+			case '"', '\\':
+				value.WriteByte(escaped)
+			default:
+				return "", p.errorf()
+			}
+		default:
+			value.WriteString(pending.String())
+			pending.Reset()
+			value.WriteByte(c)
+		}
+	}
+
+	if quoted {
+		return "", p.errorf()
+	}
+
+	return value.String(), nil
+}
+
+func (p *gitConfigParser) skipWhitespace() {
+	for !p.eof() {
+		switch p.peek() {
+		case '\n':
+			p.line++
+		case ' ', '\t', '\r':
+		default:
+			return
+		}
+		p.pos++
+	}
+}
+
+func (p *gitConfigParser) skipBlanks() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t' || p.peek() == '\r') {
+		p.pos++
+	}
+}
+
+func (p *gitConfigParser) skipLine() {
+	for !p.eof() && p.peek() != '\n' {
+		p.pos++
+	}
+}
+
+func (p *gitConfigParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *gitConfigParser) peek() byte {
+	return p.src[p.pos]
+}
+
+func (p *gitConfigParser) errorf() error {
+	return &Error{
+		Code:    ExitFatal,
+		Message: fmt.Sprintf("bad config line %d in file %s", p.line, p.file),
+	}
+}
+
+func isConfigKeyStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isConfigKeyChar(c byte) bool {
+	return isConfigKeyStart(c) || (c >= '0' && c <= '9') || c == '-'
+}
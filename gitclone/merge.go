@@ -0,0 +1,470 @@
+package gitclone
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// treeEntry is a non-directory entry of a flattened tree.
+type treeEntry struct {
+	mode filemode.FileMode
+	hash plumbing.Hash
+}
+
+// mergeConflict is a path that could not be merged automatically.
+type mergeConflict struct {
+	kind string
+	path string
+}
+
+// mergeTrees performs a three-way merge of ours and theirs against base
+// entirely in the object store. Nothing is written to the worktree, so when
+// conflicts are reported the caller can simply drop the result.
+func mergeTrees(repo *git.Repository, base, ours, theirs *object.Tree) (plumbing.Hash, []mergeConflict, error) {
+	baseEntries, err := flattenTree(base)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	ourEntries, err := flattenTree(ours)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	theirEntries, err := flattenTree(theirs)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+
+	paths := make(map[string]struct{}, len(ourEntries)+len(theirEntries))
+	for _, entries := range []map[string]treeEntry{baseEntries, ourEntries, theirEntries} {
+		for path := range entries {
+			paths[path] = struct{}{}
+		}
+	}
+
+	merged := make(map[string]treeEntry, len(paths))
+	var conflicts []mergeConflict
+	for _, path := range sortedKeys(paths) {
+		baseEntry, inBase := baseEntries[path]
+		ourEntry, inOurs := ourEntries[path]
+		theirEntry, inTheirs := theirEntries[path]
+
+		switch {
+		case inOurs == inTheirs && ourEntry == theirEntry:
+			if inOurs {
+				merged[path] = ourEntry
+			}
+		case inBase == inOurs && baseEntry == ourEntry:
+			if inTheirs {
+				merged[path] = theirEntry
+			}
+		case inBase == inTheirs && baseEntry == theirEntry:
+			if inOurs {
+				merged[path] = ourEntry
+			}
+		case !inOurs || !inTheirs:
+			conflicts = append(conflicts, mergeConflict{kind: "modify/delete", path: path})
+		default:
+			entry, ok, err := mergeFiles(repo, baseEntry, inBase, ourEntry, theirEntry)
+			if err != nil {
+				return plumbing.ZeroHash, nil, err
+			}
+			if !ok {
+				kind := "content"
+				if !inBase {
+					kind = "add/add"
+				}
+				conflicts = append(conflicts, mergeConflict{kind: kind, path: path})
+				continue
+			}
+			merged[path] = entry
+		}
+	}
+
+	reported := make(map[string]bool)
+	for path := range merged {
+		for dir := parentDir(path); dir != ""; dir = parentDir(dir) {
+			if _, ok := merged[dir]; ok && !reported[dir] {
+				reported[dir] = true
+				conflicts = append(conflicts, mergeConflict{kind: "file/directory", path: dir})
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].path < conflicts[j].path })
+		return plumbing.ZeroHash, conflicts, nil
+	}
+
+	hash, err := writeTree(repo.Storer, merged)
+	return hash, nil, err
+}
+
+// mergeFiles merges two modified regular files line by line. Symlinks,
+// submodules and binary content are only merged when one side is unchanged,
+// which mergeTrees has already handled.
+func mergeFiles(repo *git.Repository, base treeEntry, inBase bool, ours, theirs treeEntry) (treeEntry, bool, error) {
+	if !isRegularFile(ours.mode) || !isRegularFile(theirs.mode) {
+		return treeEntry{}, false, nil
+	}
+
+	mode := ours.mode
+	if ours.mode != theirs.mode {
+		switch {
+		case inBase && base.mode == ours.mode:
+			mode = theirs.mode
+		case inBase && base.mode == theirs.mode:
+			mode = ours.mode
+		default:
+			return treeEntry{}, false, nil
+		}
+	}
+
+	var baseContent []byte
+	if inBase && isRegularFile(base.mode) {
+		content, err := readBlob(repo, base.hash)
+		if err != nil {
+			return treeEntry{}, false, err
+		}
+		baseContent = content
+	}
+	ourContent, err := readBlob(repo, ours.hash)
+	if err != nil {
+		return treeEntry{}, false, err
+	}
+	theirContent, err := readBlob(repo, theirs.hash)
+	if err != nil {
+		return treeEntry{}, false, err
+	}
+
+	if isBinary(baseContent) || isBinary(ourContent) || isBinary(theirContent) {
+		return treeEntry{}, false, nil
+	}
+
+	content, ok := mergeLines(string(baseContent), string(ourContent), string(theirContent))
+	if !ok {
+		return treeEntry{}, false, nil
+	}
+
+	hash, err := writeBlob(repo.Storer, []byte(content))
+	if err != nil {
+		return treeEntry{}, false, err
+	}
+
+	return treeEntry{mode: mode, hash: hash}, true, nil
+}
+
+// lineHunk replaces base lines [start, end) with lines.
+type lineHunk struct {
+	start int
+	end   int
+	lines []string
+}
+
+// mergeLines is a diff3-style merge. Changes from both sides are applied
+// when they touch separate regions of base; overlapping or adjacent changes
+// only merge when both sides made the same edit.
+func mergeLines(base, ours, theirs string) (string, bool) {
+	baseLines := splitLines(base)
+	ourHunks := diffLines(baseLines, splitLines(ours))
+	theirHunks := diffLines(baseLines, splitLines(theirs))
+
+	var out strings.Builder
+	position := 0
+	for len(ourHunks) > 0 || len(theirHunks) > 0 {
+		var start int
+		if len(theirHunks) == 0 || (len(ourHunks) > 0 && ourHunks[0].start <= theirHunks[0].start) {
+			start = ourHunks[0].start
+		} else {
+			start = theirHunks[0].start
+		}
+
+		end := start
+		var ourGroup, theirGroup []lineHunk
+		for {
+			extended := false
+			for len(ourHunks) > 0 && ourHunks[0].start <= end {
+				end = max(end, ourHunks[0].end)
+				ourGroup = append(ourGroup, ourHunks[0])
+				ourHunks = ourHunks[1:]
+				extended = true
+			}
+			for len(theirHunks) > 0 && theirHunks[0].start <= end {
+				end = max(end, theirHunks[0].end)
+				theirGroup = append(theirGroup, theirHunks[0])
+				theirHunks = theirHunks[1:]
+				extended = true
+			}
+			if !extended {
+				break
+			}
+		}
+
+		writeLines(&out, baseLines[position:start])
+		ourResult := applyHunks(baseLines, start, end, ourGroup)
+		theirResult := applyHunks(baseLines, start, end, theirGroup)
+		switch {
+		case len(theirGroup) == 0:
+			writeLines(&out, ourResult)
+		case len(ourGroup) == 0:
+			writeLines(&out, theirResult)
+		case slicesEqual(ourResult, theirResult):
+			writeLines(&out, ourResult)
+		default:
+			return "", false
+		}
+		position = end
+	}
+	writeLines(&out, baseLines[position:])
+
+	return out.String(), true
+}
+
+// diffLines returns the hunks that turn base into other.
+func diffLines(base, other []string) []lineHunk {
+	ids := make(map[string]rune)
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffMainRunes(lineRunes(base, ids), lineRunes(other, ids), false)
+
+	var hunks []lineHunk
+	var current *lineHunk
+	basePosition, otherPosition := 0, 0
+	for _, diff := range diffs {
+		count := utf8.RuneCountInString(diff.Text)
+		if diff.Type == diffmatchpatch.DiffEqual {
+			if current != nil {
+				hunks = append(hunks, *current)
+				current = nil
+			}
+			basePosition += count
+			otherPosition += count
+			continue
+		}
+
+		if current == nil {
+			current = &lineHunk{start: basePosition, end: basePosition}
+		}
+		if diff.Type == diffmatchpatch.DiffDelete {
+			current.end += count
+			basePosition += count
+		} else {
+			current.lines = append(current.lines, other[otherPosition:otherPosition+count]...)
+			otherPosition += count
+		}
+	}
+	if current != nil {
+		hunks = append(hunks, *current)
+	}
+
+	return hunks
+}
+
+// lineRunes maps every distinct line to its own rune so the character diff
+// works on whole lines. Surrogate code points are skipped because they do
+// not survive the conversion to string inside diffmatchpatch.
+func lineRunes(lines []string, ids map[string]rune) []rune {
+	runes := make([]rune, len(lines))
+	for i, line := range lines {
+		id, ok := ids[line]
+		if !ok {
+			id = rune(len(ids) + 1)
+			if id >= 0xD800 {
+				id += 0x800
+			}
+			ids[line] = id
+		}
+		runes[i] = id
+	}
+
+	return runes
+}
+
+func applyHunks(base []string, start, end int, hunks []lineHunk) []string {
+	var result []string
+	position := start
+	for _, hunk := range hunks {
+		result = append(result, base[position:hunk.start]...)
+		result = append(result, hunk.lines...)
+		position = hunk.end
+	}
+
+	return append(result, base[position:end]...)
+}
+
+// splitLines splits text after every newline, keeping the terminators so a
+// missing final newline is preserved.
+func splitLines(text string) []string {
+	var lines []string
+	for text != "" {
+		index := strings.IndexByte(text, '\n')
+		if index < 0 {
+			lines = append(lines, text)
+			break
+		}
+		lines = append(lines, text[:index+1])
+		text = text[index+1:]
+	}
+
+	return lines
+}
+
+func writeLines(out *strings.Builder, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+}
+
+func slicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func flattenTree(tree *object.Tree) (map[string]treeEntry, error) {
+	entries := make(map[string]treeEntry)
+	if tree == nil {
+		return entries, nil
+	}
+
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode == filemode.Dir {
+			continue
+		}
+		entries[name] = treeEntry{mode: entry.Mode, hash: entry.Hash}
+	}
+}
+
+// writeTree stores the nested trees for a flattened set of entries and
+// returns the hash of the root tree.
+func writeTree(s storer.EncodedObjectStorer, entries map[string]treeEntry) (plumbing.Hash, error) {
+	var tree object.Tree
+	children := make(map[string]map[string]treeEntry)
+	for path, entry := range entries {
+		name, rest, nested := strings.Cut(path, "/")
+		if !nested {
+			tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: entry.mode, Hash: entry.hash})
+			continue
+		}
+		if children[name] == nil {
+			children[name] = make(map[string]treeEntry)
+		}
+		children[name][rest] = entry
+	}
+
+	for name, child := range children {
+		hash, err := writeTree(s, child)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: hash})
+	}
+
+	// Git orders tree entries as if directory names ended with a slash.
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return treeSortKey(tree.Entries[i]) < treeSortKey(tree.Entries[j])
+	})
+
+	obj := s.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return s.SetEncodedObject(obj)
+}
+
+func treeSortKey(entry object.TreeEntry) string {
+	if entry.Mode == filemode.Dir {
+		return entry.Name + "/"
+	}
+
+	return entry.Name
+}
+
+func writeBlob(s storer.EncodedObjectStorer, content []byte) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	writer, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := writer.Write(content); err != nil {
+		writer.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := writer.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return s.SetEncodedObject(obj)
+}
+
+func readBlob(repo *git.Repository, hash plumbing.Hash) ([]byte, error) {
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+func isRegularFile(mode filemode.FileMode) bool {
+	return mode == filemode.Regular || mode == filemode.Executable || mode == filemode.Deprecated
+}
+
+// isBinary uses git's heuristic of looking for a NUL byte near the start.
+func isBinary(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+func parentDir(path string) string {
+	index := strings.LastIndexByte(path, '/')
+	if index < 0 {
+		return ""
+	}
+
+	return path[:index]
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
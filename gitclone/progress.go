@@ -0,0 +1,414 @@
+package gitclone
+
+import (
+	"context"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Progress receives the progress of a clone or pull. Write gets the text
+// git shows on stderr while objects are transferred: the server's
+// sideband progress lines, which ParseProgressLine recognizes, and its
+// remote: messages. The Report methods are told what the text does not
+// cover: the phases go-git does not report itself, receiving objects and
+// checking out files, and the refs and submodules the run resolves.
+//
+// Methods may be called from more than one goroutine.
+type Progress interface {
+	Write(p []byte) (int, error)
+	ReportProgress(event ProgressEvent)
+	ReportRef(event RefEvent)
+	ReportSubmodule(event SubmoduleEvent)
+}
+
+// ProgressEvent is one update of a transfer phase such as counting,
+// compressing or receiving objects, or resolving deltas. Phase is git's
+// label in lower-kebab case, for example "receiving-objects".
+type ProgressEvent struct {
+	Event      string `json:"event"`
+	Phase      string `json:"phase"`
+	Current    int64  `json:"current"`
+	Total      int64  `json:"total,omitempty"`
+	Percent    int    `json:"percent,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	Throughput int64  `json:"throughput,omitempty"`
+	Done       bool   `json:"done,omitempty"`
+}
+
+// RefEvent reports the ref a clone or pull resolved to (Event "ref") and
+// the commit the worktree was moved to (Event "checkout").
+type RefEvent struct {
+	Event  string `json:"event"`
+	Ref    string `json:"ref"`
+	Commit string `json:"commit,omitempty"`
+}
+
+// SubmoduleEvent is sent before each submodule is brought in line; Status
+// is "updating" when it is checked out and "up-to-date" when it already is.
+type SubmoduleEvent struct {
+	Event  string `json:"event"`
+	Path   string `json:"path"`
+	URL    string `json:"url"`
+	Commit string `json:"commit,omitempty"`
+	Status string `json:"status"`
+}
+
+// transferPollInterval is how often watchTransfer looks at the bytes
+// received.
+const transferPollInterval = 250 * time.Millisecond
+
+// watchTransfer reports the receiving-objects phase while a clone or fetch
+// runs, and aborts the run when less than opts.LowSpeedLimit bytes arrive
+// in opts.LowSpeedTime of a transfer phase. The bytes are those the
+// upload-pack responses of the run delivered, as countTransports counts
+// them. The returned function stops watching and reports the phase as done
+// if anything arrived; calling it again does nothing.
+func watchTransfer(opts Options, stderr *output) func() {
+	reporter := stderr.progress
+	lowSpeed := opts.LowSpeedLimit > 0 && opts.LowSpeedTime > 0
+	if reporter == nil && !lowSpeed {
+		return func() {}
+	}
+
+	base := stderr.received.Load()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	var received int64
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(transferPollInterval)
+		defer ticker.Stop()
+
+		last := time.Now()
+		windowStart, windowSize := last, int64(0)
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				size := stderr.received.Load() - base
+				if !transferPhases[stderr.currentPhase()] {
+					windowStart, windowSize = now, size
+				} else if elapsed := now.Sub(windowStart); lowSpeed && elapsed >= opts.LowSpeedTime {
+					if float64(size-windowSize) < float64(opts.LowSpeedLimit)*elapsed.Seconds() {
+						stderr.timeOut("transfer slower than %d bytes/s for %s", opts.LowSpeedLimit, opts.LowSpeedTime)
+						return
+					}
+					windowStart, windowSize = now, size
+				}
+				if reporter == nil || size <= received {
+					continue
+				}
+				throughput := float64(size-received) / now.Sub(last).Seconds()
+				received, last = size, now
+				reporter.ReportProgress(ProgressEvent{
+					Event:      "progress",
+					Phase:      "receiving-objects",
+					Bytes:      received,
+					Throughput: int64(throughput),
+				})
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+			if reporter == nil {
+				return
+			}
+			if size := stderr.received.Load() - base; size > 0 {
+				reporter.ReportProgress(ProgressEvent{Event: "progress", Phase: "receiving-objects", Bytes: size, Done: true})
+			}
+		})
+	}
+}
+
+// countingTransport counts the bytes the upload-pack responses of its
+// sessions deliver: the sideband stream that carries the pack, read as
+// go-git reads it off the connection, whatever the protocol.
+type countingTransport struct {
+	next     transport.Transport
+	received *atomic.Int64
+}
+
+func (t *countingTransport) NewUploadPackSession(endpoint *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	session, err := t.next.NewUploadPackSession(endpoint, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return &countingSession{UploadPackSession: session, received: t.received}, nil
+}
+
+func (t *countingTransport) NewReceivePackSession(endpoint *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	return t.next.NewReceivePackSession(endpoint, auth)
+}
+
+type countingSession struct {
+	transport.UploadPackSession
+	received *atomic.Int64
+}
+
+func (s *countingSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	response, err := s.UploadPackSession.UploadPack(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The shallow update and acknowledgements are already decoded; what is
+	// left to read is the pack, so only the reader is replaced.
+	counted := packp.NewUploadPackResponseWithPackfile(req, &countingReader{ReadCloser: response, received: s.received})
+	counted.ShallowUpdate = response.ShallowUpdate
+	counted.ServerResponse = response.ServerResponse
+
+	return counted, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	received *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.received.Add(int64(n))
+
+	return n, err
+}
+
+// countTransports wraps every transport of a run so that watchTransfer sees
+// the bytes it receives.
+func countTransports(protocols map[string]transport.Transport, stderr *output) map[string]transport.Transport {
+	counted := make(map[string]transport.Transport, len(protocols))
+	for name, t := range protocols {
+		counted[name] = &countingTransport{next: t, received: &stderr.received}
+	}
+
+	return counted
+}
+
+// checkoutCounter reports the checking-out-files phase. It only reports
+// when the percentage changes, so large checkouts do not flood the
+// reporter, and leaves the last file to finish.
+type checkoutCounter struct {
+	mu       sync.Mutex
+	reporter Progress
+	current  int64
+	total    int64
+	percent  int
+}
+
+func (c *checkoutCounter) increment() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current = min(c.current+1, c.total)
+	if percent := int(c.current * 100 / c.total); percent != c.percent && c.current < c.total {
+		c.percent = percent
+		c.report(false)
+	}
+}
+
+func (c *checkoutCounter) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current = c.total
+	c.report(true)
+}
+
+func (c *checkoutCounter) report(done bool) {
+	c.reporter.ReportProgress(ProgressEvent{
+		Event:   "progress",
+		Phase:   "checking-out-files",
+		Current: c.current,
+		Total:   c.total,
+		Percent: int(c.current * 100 / c.total),
+		Done:    done,
+	})
+}
+
+// countingFilesystem counts the files and symlinks go-git creates while it
+// checks out a worktree.
+type countingFilesystem struct {
+	billy.Filesystem
+	created func()
+}
+
+func (fs *countingFilesystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	file, err := fs.Filesystem.OpenFile(filename, flag, perm)
+	if err == nil && flag&os.O_CREATE != 0 {
+		fs.created()
+	}
+	return file, err
+}
+
+func (fs *countingFilesystem) Symlink(target, link string) error {
+	err := fs.Filesystem.Symlink(target, link)
+	if err == nil {
+		fs.created()
+	}
+	return err
+}
+
+// checkoutHead populates the worktree of a fresh clone the way go-git's own
+// clone does, reporting each file to the progress sink.
+func checkoutHead(repo *git.Repository, stderr *output) error {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+
+	defer stderr.phase("checkout")()
+
+	stderr.stats.countCheckouts(worktree)
+	var counter *checkoutCounter
+	if stderr.progress != nil {
+		total, err := checkoutFileCount(repo, head.Hash())
+		if err != nil {
+			return err
+		}
+		if total > 0 {
+			counter = &checkoutCounter{reporter: stderr.progress, total: total, percent: -1}
+			worktree.Filesystem = &countingFilesystem{Filesystem: worktree.Filesystem, created: counter.increment}
+		}
+	}
+
+	if err := worktree.Reset(&git.ResetOptions{Mode: git.MergeReset, Commit: head.Hash()}); err != nil {
+		return err
+	}
+	if counter != nil {
+		counter.finish()
+	}
+
+	return nil
+}
+
+// checkoutFileCount is the number of files and symlinks in the tree of
+// commit; submodules are checked out separately.
+func checkoutFileCount(repo *git.Repository, commit plumbing.Hash) (int64, error) {
+	c, err := repo.CommitObject(commit)
+	if err != nil {
+		return 0, err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return 0, err
+	}
+	entries, err := flattenTree(tree)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, entry := range entries {
+		if entry.mode != filemode.Submodule {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func reportRef(stderr *output, event string, ref plumbing.ReferenceName, commit plumbing.Hash) {
+	if stderr.progress == nil {
+		return
+	}
+
+	refEvent := RefEvent{Event: event, Ref: ref.String()}
+	if !commit.IsZero() {
+		refEvent.Commit = commit.String()
+	}
+	stderr.progress.ReportRef(refEvent)
+}
+
+// reportHead reports what HEAD resolves to, see resolvedHead.
+func reportHead(stderr *output, event string, repo *git.Repository) error {
+	if stderr.progress == nil {
+		return nil
+	}
+
+	ref, commit, err := resolvedHead(repo)
+	if err != nil {
+		return err
+	}
+	reportRef(stderr, event, plumbing.ReferenceName(ref), commit)
+
+	return nil
+}
+
+var progressLinePattern = regexp.MustCompile(
+	`^(?:remote: )?([A-Z][a-z]*(?: [a-z]+)*):\s+(?:(\d+)% \((\d+)/(\d+)\)|(\d+))` +
+		`(?:, ([\d.]+ (?:bytes|[KMG]iB))(?: \| ([\d.]+ (?:bytes|[KMG]iB))/s)?)?(, done\.?)?$`)
+
+// ParseProgressLine recognizes git's progress lines, for example
+// "Receiving objects:  45% (10/22), 1.20 MiB | 1.10 MiB/s" or
+// "Enumerating objects: 5, done.".
+func ParseProgressLine(line string) (ProgressEvent, bool) {
+	match := progressLinePattern.FindStringSubmatch(line)
+	if match == nil {
+		return ProgressEvent{}, false
+	}
+
+	event := ProgressEvent{
+		Event: "progress",
+		Phase: strings.ReplaceAll(strings.ToLower(match[1]), " ", "-"),
+		Done:  match[8] != "",
+	}
+	if match[2] != "" {
+		event.Percent, _ = strconv.Atoi(match[2])
+		event.Current, _ = strconv.ParseInt(match[3], 10, 64)
+		event.Total, _ = strconv.ParseInt(match[4], 10, 64)
+	} else {
+		event.Current, _ = strconv.ParseInt(match[5], 10, 64)
+	}
+	event.Bytes = parseByteSize(match[6])
+	event.Throughput = parseByteSize(match[7])
+
+	return event, true
+}
+
+// parseByteSize reads git's human-readable sizes such as "512 bytes" or
+// "1.20 MiB".
+func parseByteSize(value string) int64 {
+	number, unit, ok := strings.Cut(value, " ")
+	if !ok {
+		return 0
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0
+	}
+
+	switch unit {
+	case "KiB":
+		size *= 1 << 10
+	case "MiB":
+		size *= 1 << 20
+	case "GiB":
+		size *= 1 << 30
+	}
+
+	return int64(size)
+}
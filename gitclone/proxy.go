@@ -0,0 +1,246 @@
+package gitclone
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// proxyResolver picks the proxy for an endpoint using git's precedence:
+// remote.<name>.proxy for the cloned remote, then http.proxy, then the
+// environment, with NO_PROXY applied last.
+type proxyResolver struct {
+	config     *Config
+	remoteName string
+	remote     *transport.Endpoint
+	getenv     func(string) string
+}
+
+func newProxyResolver(opts Options) *proxyResolver {
+	resolver := &proxyResolver{
+		config:     opts.Config,
+		remoteName: opts.RemoteName,
+		getenv:     os.Getenv,
+	}
+	if endpoint, err := transport.NewEndpoint(opts.fetchURL()); err == nil {
+		resolver.remote = endpoint
+	}
+
+	return resolver
+}
+
+// httpProxy is installed as the Proxy function of the HTTP transport so that
+// every request, including redirects and submodule fetches, is resolved.
+func (r *proxyResolver) httpProxy(req *http.Request) (*url.URL, error) {
+	endpoint := &transport.Endpoint{
+		Protocol: req.URL.Scheme,
+		Host:     req.URL.Hostname(),
+		Path:     req.URL.Path,
+	}
+	if port, err := strconv.Atoi(req.URL.Port()); err == nil {
+		endpoint.Port = port
+	}
+
+	proxy, err := r.proxyFor(endpoint)
+	if err != nil || proxy.URL == "" {
+		return nil, err
+	}
+
+	return proxy.FullURL()
+}
+
+func (r *proxyResolver) proxyFor(endpoint *transport.Endpoint) (transport.ProxyOptions, error) {
+	rawProxy, configured := r.configuredProxy(endpoint)
+	if !configured {
+		rawProxy = r.environmentProxy(endpoint.Protocol)
+	}
+
+	if rawProxy == "" || r.bypassed(endpoint.Host, endpoint.Port) {
+		return transport.ProxyOptions{}, nil
+	}
+
+	return parseProxyURL(rawProxy, endpoint.Protocol)
+}
+
+func (r *proxyResolver) configuredProxy(endpoint *transport.Endpoint) (string, bool) {
+	if r.isRemote(endpoint) {
+		// An empty remote.<name>.proxy disables proxying for that remote.
+		if value, ok := r.config.Get("remote", r.remoteName, "proxy"); ok {
+			return value, true
+		}
+	}
+
+	if endpoint.Protocol == "http" || endpoint.Protocol == "https" {
+		if value, ok := r.config.ForURL(endpoint.String()).Get("http", "", "proxy"); ok {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// isRemote reports whether endpoint addresses the cloned remote. HTTP
+// requests carry service suffixes such as /info/refs, so the path only has to
+// start with the remote path.
+func (r *proxyResolver) isRemote(endpoint *transport.Endpoint) bool {
+	if r.remote == nil ||
+		r.remote.Protocol != endpoint.Protocol ||
+		!strings.EqualFold(r.remote.Host, endpoint.Host) ||
+		r.remote.Port != endpoint.Port {
+		return false
+	}
+
+	remotePath := strings.TrimSuffix(r.remote.Path, "/")
+	return endpoint.Path == remotePath || strings.HasPrefix(endpoint.Path, remotePath+"/")
+}
+
+func (r *proxyResolver) environmentProxy(protocol string) string {
+	var names []string
+	switch protocol {
+	case "https":
+		names = []string{"https_proxy", "HTTPS_PROXY"}
+	case "http":
+		names = []string{"http_proxy", "HTTP_PROXY"}
+	}
+	names = append(names, "all_proxy", "ALL_PROXY")
+
+	for _, name := range names {
+		if value := r.getenv(name); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func (r *proxyResolver) bypassed(host string, port int) bool {
+	noProxy := r.getenv("no_proxy")
+	if noProxy == "" {
+		noProxy = r.getenv("NO_PROXY")
+	}
+
+	return matchesNoProxy(noProxy, host, port)
+}
+
+// matchesNoProxy reports whether host is excluded by a curl-style NO_PROXY
+// list: "*", domain suffixes with or without a leading dot, optional ports
+// and CIDR ranges.
+func matchesNoProxy(noProxy, host string, port int) bool {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "" {
+		return false
+	}
+	hostIP := net.ParseIP(host)
+
+	for _, rawEntry := range strings.Split(noProxy, ",") {
+		entry := strings.ToLower(strings.TrimSpace(rawEntry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if hostIP != nil && network.Contains(hostIP) {
+				return true
+			}
+			continue
+		}
+
+		entryHost := entry
+		if splitHost, splitPort, err := net.SplitHostPort(entry); err == nil {
+			entryPort, convErr := strconv.Atoi(splitPort)
+			if convErr != nil || entryPort != port {
+				continue
+			}
+			entryHost = splitHost
+		}
+		entryHost = strings.TrimPrefix(strings.Trim(entryHost, "[]"), ".")
+
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseProxyURL(rawProxy, protocol string) (transport.ProxyOptions, error) {
+	if !strings.Contains(rawProxy, "://") {
+		rawProxy = "http://" + rawProxy
+	}
+
+	proxyURL, err := url.Parse(rawProxy)
+	if err != nil || proxyURL.Host == "" {
+		return transport.ProxyOptions{}, &Error{
+			Code:    ExitFatal,
+			Message: fmt.Sprintf("invalid proxy URL '%s'", redactProxyURL(rawProxy)),
+		}
+	}
+
+	switch proxyURL.Scheme {
+	case "socks":
+		proxyURL.Scheme = "socks5"
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return transport.ProxyOptions{}, &Error{
+			Code:    ExitFatal,
+			Message: fmt.Sprintf("unsupported proxy scheme '%s'", proxyURL.Scheme),
+		}
+	}
+
+	// SSH sessions can only be tunnelled through SOCKS; HTTP proxies are
+	// ignored for them just like git does.
+	if protocol == "ssh" && !strings.HasPrefix(proxyURL.Scheme, "socks5") {
+		return transport.ProxyOptions{}, nil
+	}
+
+	options := transport.ProxyOptions{}
+	if proxyURL.User != nil {
+		options.Username = proxyURL.User.Username()
+		options.Password, _ = proxyURL.User.Password()
+		proxyURL.User = nil
+	}
+	options.URL = proxyURL.String()
+
+	return options, nil
+}
+
+// redactProxyURL hides the password of a proxy URL. A URL that does not
+// parse goes through dropUserInfo instead.
+func redactProxyURL(rawProxy string) string {
+	proxyURL, err := url.Parse(rawProxy)
+	if err == nil {
+		if proxyURL.User == nil {
+			return rawProxy
+		}
+		return proxyURL.Redacted()
+	}
+
+	return dropUserInfo(rawProxy)
+}
+
+// dropUserInfo is the fallback for URLs that do not parse: everything up to
+// the last "@" after the scheme goes, which may be a password that contains
+// "@" itself.
+func dropUserInfo(rawURL string) string {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		scheme, rest = "", rawURL
+	}
+	if at := strings.LastIndex(rest, "@"); at >= 0 {
+		rest = rest[at+1:]
+	}
+	if !ok {
+		return rest
+	}
+
+	return scheme + "://" + rest
+}
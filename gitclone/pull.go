@@ -0,0 +1,1339 @@
+package gitclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// verifyRemote makes sure the existing repository tracks the repository the
+// caller asked for, so --pull never updates an unrelated checkout that
+// happens to live at the destination. With --set-url a mismatching or
+// missing remote is repointed instead.
+func verifyRemote(repo *git.Repository, opts Options, stderr io.Writer) error {
+	remote, err := repo.Remote(opts.RemoteName)
+	if errors.Is(err, git.ErrRemoteNotFound) {
+		if !opts.SetURL {
+			return &Error{
+				Code:    ExitFatal,
+				Message: fmt.Sprintf("No such remote '%s'; use --set-url to add it", opts.RemoteName),
+			}
+		}
+		_, err = repo.CreateRemote(&config.RemoteConfig{
+			Name: opts.RemoteName,
+			URLs: []string{opts.Repository},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	remoteConfig := remote.Config()
+	var configured string
+	if len(remoteConfig.URLs) > 0 {
+		configured = remoteConfig.URLs[0]
+	}
+	if sameRepositoryURL(opts.Config.FetchURL(configured), opts.fetchURL()) {
+		return nil
+	}
+
+	if !opts.SetURL {
+		return &Error{
+			Code:    ExitFatal,
+			Message: fmt.Sprintf("remote '%s' points to '%s', not '%s'; use --set-url to repoint it", opts.RemoteName, ScrubURL(configured), ScrubURL(opts.Repository)),
+		}
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Remotes[opts.RemoteName].URLs = []string{opts.Repository}
+	if err := repo.SetConfig(cfg); err != nil {
+		return err
+	}
+
+	if !opts.Quiet {
+		fmt.Fprintf(stderr, "Changed URL of remote '%s' from '%s' to '%s'\n", opts.RemoteName, ScrubURL(configured), ScrubURL(opts.Repository))
+	}
+	return nil
+}
+
+// sameRepositoryURL compares two remote URLs after normalizing away the
+// differences that still reach the same repository: the scheme and user,
+// default ports, host case, scp-like syntax, and trailing slashes or .git.
+func sameRepositoryURL(a, b string) bool {
+	return normalizeRepositoryURL(a) == normalizeRepositoryURL(b)
+}
+
+func normalizeRepositoryURL(rawURL string) string {
+	endpoint, err := transport.NewEndpoint(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	if endpoint.Protocol == "file" {
+		// Relative paths are relative to where the pull runs.
+		local, err := filepath.Abs(filepath.FromSlash(endpoint.Path))
+		if err != nil {
+			return rawURL
+		}
+		return "file:" + strings.TrimSuffix(strings.TrimRight(filepath.ToSlash(local), "/"), ".git")
+	}
+
+	repoPath := strings.TrimSuffix(strings.Trim(endpoint.Path, "/"), ".git")
+	host := strings.ToLower(endpoint.Host)
+	switch endpoint.Port {
+	case 0, 22, 80, 443, 9418:
+	default:
+		host = fmt.Sprintf("%s:%d", host, endpoint.Port)
+	}
+
+	return host + "/" + repoPath
+}
+
+// pullBare brings a bare or mirror repository up to date. There is no
+// branch to integrate into, so the remote's configured refspecs are fetched
+// and, with opts.Prune, refs deleted upstream are removed. A mirror follows
+// every ref with force; a plain bare clone also keeps its own branches in
+// step with the remote, as they are what a bare clone mirrors, but only
+// fast-forwards them. It reports whether any ref changed.
+func pullBare(ctx context.Context, repo *git.Repository, opts Options, auth transport.AuthMethod, stderr *output) (bool, error) {
+	if opts.Branch != "" {
+		return false, &Error{
+			Code:    ExitFatal,
+			Message: "--pull -b is not supported for bare repositories",
+		}
+	}
+
+	remote, err := repo.Remote(opts.RemoteName)
+	if err != nil {
+		return false, err
+	}
+	// A bare repository, mirror or not, only follows the remote.
+	opts.Prune = !opts.NoPrune
+
+	mirror := remote.Config().Mirror
+	var extra []config.RefSpec
+	if !mirror {
+		extra = append(extra, "refs/heads/*:refs/heads/*")
+	}
+	refSpecs, err := pullRefSpecs(repo, opts, extra...)
+	if err != nil {
+		return false, err
+	}
+
+	tags := git.AllTags
+	if opts.Tags == git.NoTags {
+		tags = git.NoTags
+	}
+
+	before, err := referenceHashes(repo)
+	if err != nil {
+		return false, err
+	}
+	err = fetchWithPrune(ctx, repo, &git.FetchOptions{
+		RemoteName: opts.RemoteName,
+		RemoteURL:  opts.fetchURL(),
+		RefSpecs:   refSpecs,
+		Depth:      opts.Depth,
+		Progress:   stderr.sideband(),
+		Auth:       auth,
+		Tags:       tags,
+		Force:      mirror,
+		Prune:      opts.Prune,
+	}, opts, stderr)
+	if errors.Is(err, git.ErrForceNeeded) {
+		return false, &Error{
+			Code:    ExitFatal,
+			Message: "some local branches were not updated because they would not fast-forward to the remote",
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	after, err := referenceHashes(repo)
+	if err != nil {
+		return false, err
+	}
+
+	return !maps.Equal(before, after), nil
+}
+
+// pullRefSpecs is what a pull fetches: the remote's configured refspecs,
+// the extra ones the caller needs, and every tag when --prune-tags is in
+// effect, since that is how git prunes tags.
+func pullRefSpecs(repo *git.Repository, opts Options, extra ...config.RefSpec) ([]config.RefSpec, error) {
+	remote, err := repo.Remote(opts.RemoteName)
+	if err != nil {
+		return nil, err
+	}
+
+	refSpecs := append([]config.RefSpec(nil), remote.Config().Fetch...)
+	if opts.Prune && opts.PruneTags {
+		extra = append(extra, "+refs/tags/*:refs/tags/*")
+	}
+	for _, refSpec := range extra {
+		if !containsRefSpec(refSpecs, refSpec) {
+			refSpecs = append(refSpecs, refSpec)
+		}
+	}
+
+	return refSpecs, nil
+}
+
+// fetchWithPrune runs a fetch, retrying transient failures, and when it
+// prunes in verbose mode lists the refs that were removed like git fetch
+// --prune does.
+func fetchWithPrune(ctx context.Context, repo *git.Repository, options *git.FetchOptions, opts Options, stderr *output) error {
+	defer stderr.phase("fetch")()
+
+	var before map[plumbing.ReferenceName]plumbing.Hash
+	if options.Prune && opts.Verbose {
+		names, err := referenceHashes(repo)
+		if err != nil {
+			return err
+		}
+		before = names
+	}
+
+	err := withRetries(ctx, opts, stderr, "fetch", func() error {
+		return repo.FetchContext(ctx, options)
+	}, nil)
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+
+	if before == nil {
+		return nil
+	}
+
+	after, err := referenceHashes(repo)
+	if err != nil {
+		return err
+	}
+
+	var removed []string
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			removed = append(removed, name.Short())
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		fmt.Fprintf(stderr, " - %-17s %-10s -> %s\n", "[deleted]", "(none)", name)
+	}
+
+	return nil
+}
+
+func referenceHashes(repo *git.Repository) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[plumbing.ReferenceName]plumbing.Hash)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			hashes[ref.Name()] = ref.Hash()
+		}
+		return nil
+	})
+
+	return hashes, err
+}
+
+func containsRefSpec(refSpecs []config.RefSpec, target config.RefSpec) bool {
+	for _, refSpec := range refSpecs {
+		if refSpec == target {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pullCheckout updates a repository with a worktree. Branches are pulled
+// from their upstream; a tag named with -b, or the tag a detached HEAD sits
+// on, is refetched and checked out again if it moved. It reports whether
+// HEAD moved.
+func pullCheckout(ctx context.Context, repo *git.Repository, opts Options, auth transport.AuthMethod, stderr *output) (updated bool, err error) {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return false, err
+	}
+	changes, err := pendingChanges(worktree, opts)
+	if err != nil {
+		return false, err
+	}
+
+	var tagName plumbing.ReferenceName
+	if opts.Branch != "" {
+		targetRef, err := resolveCloneReference(ctx, opts, auth, stderr)
+		if err != nil {
+			return false, err
+		}
+		if targetRef.IsTag() {
+			tagName = targetRef
+		} else {
+			stash, err := switchBranch(repo, worktree, targetRef, changes, opts, stderr)
+			if stash != nil {
+				changes = nil
+				defer func() {
+					if applyErr := restoreAutostash(repo, worktree, stash, opts, stderr); err == nil {
+						err = applyErr
+					}
+				}()
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return false, err
+	}
+
+	if tagName == "" && !head.Name().IsBranch() {
+		tagName, err = tagAtCommit(repo, head.Hash())
+		if err != nil {
+			return false, err
+		}
+	}
+	if tagName != "" {
+		return pullTag(ctx, repo, worktree, head, tagName, changes, opts, auth, stderr)
+	}
+
+	return pullBranch(ctx, repo, worktree, head, changes, opts, auth, stderr)
+}
+
+// switchBranch checks out the branch -b names unless it already is. Local
+// changes that --autostash lets through are stashed first and returned, to
+// be reapplied once the pull is done, which carries them over to the branch
+// like git switch does; --reset discards them.
+func switchBranch(
+	repo *git.Repository,
+	worktree *git.Worktree,
+	branchRef plumbing.ReferenceName,
+	changes []localChange,
+	opts Options,
+	stderr *output,
+) (*autostash, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	if head.Name() == branchRef {
+		return nil, nil
+	}
+
+	var stash *autostash
+	if len(changes) > 0 {
+		if stash, err = createAutostash(repo, head, changes, opts.Config); err != nil {
+			return nil, err
+		}
+		if !opts.Quiet {
+			fmt.Fprintf(stderr, "Created autostash: %s\n", stash.commit.Hash.String()[:7])
+		}
+	}
+	if stash != nil || opts.Reset {
+		if err := hardReset(repo, worktree, head.Hash(), stderr); err != nil {
+			return stash, err
+		}
+	}
+
+	return stash, checkoutBranch(repo, opts.RemoteName, branchRef)
+}
+
+// pullBranch fetches the upstream of the checked out branch and integrates
+// it according to opts.PullMode. Merges and rebases are computed in the
+// object store first, so a conflict leaves the branch and the worktree
+// untouched.
+func pullBranch(
+	ctx context.Context,
+	repo *git.Repository,
+	worktree *git.Worktree,
+	head *plumbing.Reference,
+	changes []localChange,
+	opts Options,
+	auth transport.AuthMethod,
+	stderr *output,
+) (bool, error) {
+	stderr.stats.countCheckouts(worktree)
+
+	upstream, err := fetchUpstream(ctx, repo, head, opts, auth, stderr)
+	if err != nil {
+		return false, err
+	}
+	reportRef(stderr, "ref", upstream.Name(), upstream.Hash())
+
+	if opts.Reset {
+		return forceCheckout(repo, worktree, head, upstream.Hash(), opts, stderr)
+	}
+
+	target, err := integrateUpstream(repo, head, upstream, opts)
+	if err != nil {
+		return false, err
+	}
+	if target == head.Hash() {
+		if !opts.Quiet {
+			fmt.Fprintln(stderr, "Already up to date.")
+		}
+		return false, nil
+	}
+
+	if err := updateCheckout(repo, worktree, head, target, changes, opts, stderr); err != nil {
+		return false, err
+	}
+	if opts.Quiet {
+		return true, nil
+	}
+
+	switch {
+	case target == upstream.Hash():
+		return true, printUpdateSummary(repo, head.Hash(), target, false, opts.Verbose, stderr)
+	case opts.PullMode == PullRebase:
+		fmt.Fprintf(stderr, "Successfully rebased and updated %s.\n", head.Name())
+		return true, nil
+	}
+
+	return true, printUpdateSummary(repo, head.Hash(), target, true, opts.Verbose, stderr)
+}
+
+// pullTag refetches a tag, replacing the local one if it moved upstream, and
+// checks it out on a detached HEAD like git clone -b <tag> does.
+func pullTag(
+	ctx context.Context,
+	repo *git.Repository,
+	worktree *git.Worktree,
+	head *plumbing.Reference,
+	tagName plumbing.ReferenceName,
+	changes []localChange,
+	opts Options,
+	auth transport.AuthMethod,
+	stderr *output,
+) (updated bool, err error) {
+	stderr.stats.countCheckouts(worktree)
+
+	refSpecs, err := pullRefSpecs(repo, opts, config.RefSpec(fmt.Sprintf("+%s:%s", tagName, tagName)))
+	if err != nil {
+		return false, err
+	}
+
+	err = fetchWithPrune(ctx, repo, &git.FetchOptions{
+		RemoteName: opts.RemoteName,
+		RemoteURL:  opts.fetchURL(),
+		RefSpecs:   refSpecs,
+		Depth:      opts.Depth,
+		Progress:   stderr.sideband(),
+		Auth:       auth,
+		Tags:       git.NoTags,
+		Force:      true,
+		Prune:      opts.Prune,
+	}, opts, stderr)
+	if err != nil {
+		return false, err
+	}
+
+	target, err := tagCommit(repo, tagName)
+	if err != nil {
+		return false, err
+	}
+	reportRef(stderr, "ref", tagName, target)
+
+	// Detach first so that the update below moves HEAD and leaves the
+	// branch that was checked out where it is. An update that fails before
+	// HEAD moved checks the branch out again.
+	if head.Name() != plumbing.HEAD {
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, head.Hash())); err != nil {
+			return false, err
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			// The error of the update is what gets reported, so a failed
+			// restore is left at that.
+			if current, headErr := repo.Storer.Reference(plumbing.HEAD); headErr == nil && current.Hash() == head.Hash() {
+				_ = repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, head.Name()))
+			}
+		}()
+	}
+
+	if opts.Reset {
+		return forceCheckout(repo, worktree, head, target, opts, stderr)
+	}
+	if target == head.Hash() {
+		if !opts.Quiet {
+			fmt.Fprintln(stderr, "Already up to date.")
+		}
+		return false, nil
+	}
+
+	if err := updateCheckout(repo, worktree, head, target, changes, opts, stderr); err != nil {
+		return false, err
+	}
+	if opts.Quiet {
+		return true, nil
+	}
+
+	return true, printUpdateSummary(repo, head.Hash(), target, false, opts.Verbose, stderr)
+}
+
+// pendingChanges returns the uncommitted changes the update has to carry
+// along. They abort the pull before anything is fetched unless --autostash
+// is set, and --reset discards them.
+func pendingChanges(worktree *git.Worktree, opts Options) ([]localChange, error) {
+	if opts.Reset {
+		return nil, nil
+	}
+
+	changes, err := localChanges(worktree)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) > 0 && !opts.Autostash {
+		return nil, dirtyWorktreeError(changes)
+	}
+
+	return changes, nil
+}
+
+// updateCheckout moves HEAD, the index and the worktree to target. Local
+// changes have been checked by pendingChanges, so any left are autostashed
+// and reapplied afterwards.
+func updateCheckout(
+	repo *git.Repository,
+	worktree *git.Worktree,
+	head *plumbing.Reference,
+	target plumbing.Hash,
+	changes []localChange,
+	opts Options,
+	stderr *output,
+) error {
+	if err := checkUntrackedOverwrite(repo, worktree, target); err != nil {
+		return err
+	}
+
+	// The worktree has been checked to be clean, so a hard reset only
+	// updates what changed between the commits.
+	if len(changes) == 0 {
+		return keepRemovedSubmodules(repo, worktree, head.Hash(), target, func() error {
+			return hardReset(repo, worktree, target, stderr)
+		})
+	}
+
+	stash, err := createAutostash(repo, head, changes, opts.Config)
+	if err != nil {
+		return err
+	}
+	if !opts.Quiet {
+		fmt.Fprintf(stderr, "Created autostash: %s\n", stash.commit.Hash.String()[:7])
+	}
+	if err := keepRemovedSubmodules(repo, worktree, head.Hash(), target, func() error {
+		return hardReset(repo, worktree, target, stderr)
+	}); err != nil {
+		return err
+	}
+
+	return restoreAutostash(repo, worktree, stash, opts, stderr)
+}
+
+// restoreAutostash reapplies stash on top of HEAD.
+func restoreAutostash(repo *git.Repository, worktree *git.Worktree, stash *autostash, opts Options, stderr *output) error {
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	if err := stash.apply(repo, worktree, head.Hash()); err != nil {
+		return err
+	}
+	if !opts.Quiet {
+		fmt.Fprintln(stderr, "Applied autostash.")
+	}
+
+	return nil
+}
+
+// forceCheckout implements --reset: HEAD, the index and the worktree are
+// forced to target, discarding local commits and edits, and with --clean
+// untracked files are removed as well. Without --clean, untracked files in
+// the way of target abort the reset.
+func forceCheckout(
+	repo *git.Repository,
+	worktree *git.Worktree,
+	head *plumbing.Reference,
+	target plumbing.Hash,
+	opts Options,
+	stderr *output,
+) (bool, error) {
+	if !opts.Clean {
+		if err := checkUntrackedOverwrite(repo, worktree, target); err != nil {
+			return false, err
+		}
+	}
+
+	if err := keepRemovedSubmodules(repo, worktree, head.Hash(), target, func() error {
+		return hardReset(repo, worktree, target, stderr)
+	}); err != nil {
+		return false, err
+	}
+
+	if opts.Clean {
+		if err := cleanUntracked(worktree); err != nil {
+			return false, err
+		}
+	}
+
+	if !opts.Quiet {
+		if err := printHeadChange(repo, head.Hash(), target, stderr); err != nil {
+			return false, err
+		}
+	}
+
+	return target != head.Hash(), nil
+}
+
+// cleanUntracked is git clean -d: untracked files are removed along with the
+// directories they leave empty, and ignored files are kept. go-git's Clean
+// also deletes nested repositories, such as the checkouts of submodules
+// removed upstream, which git clean only does when forced twice, so files
+// below a directory with a .git are left alone.
+func cleanUntracked(worktree *git.Worktree) error {
+	status, err := worktree.Status()
+	if err != nil {
+		return err
+	}
+
+	root := worktree.Filesystem.Root()
+	for filePath, fileStatus := range status {
+		if fileStatus.Worktree != git.Untracked || insideNestedRepository(root, filePath) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(root, filepath.FromSlash(filePath))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		// Directories that still hold something are not empty and stay.
+		for dir := path.Dir(filePath); dir != "."; dir = path.Dir(dir) {
+			if os.Remove(filepath.Join(root, filepath.FromSlash(dir))) != nil {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// insideNestedRepository reports whether filePath is below a directory of
+// the worktree that is a repository of its own.
+func insideNestedRepository(root, filePath string) bool {
+	for dir := path.Dir(filePath); dir != "."; dir = path.Dir(dir) {
+		if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(dir), git.GitDirName)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tagAtCommit finds the tag a detached HEAD was checked out from.
+func tagAtCommit(repo *git.Repository, hash plumbing.Hash) (plumbing.ReferenceName, error) {
+	tags, err := repo.Tags()
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		commit, err := tagCommit(repo, ref.Name())
+		if err != nil {
+			return err
+		}
+		if commit == hash {
+			matches = append(matches, ref.Name().String())
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(matches) == 0 {
+		return "", &Error{
+			Code:    ExitFatal,
+			Message: "--pull on a detached HEAD requires -b <tag> or a tag at HEAD",
+		}
+	}
+	sort.Strings(matches)
+
+	return plumbing.ReferenceName(matches[0]), nil
+}
+
+// tagCommit peels a lightweight or annotated tag to its commit.
+func tagCommit(repo *git.Repository, name plumbing.ReferenceName) (plumbing.Hash, error) {
+	ref, err := repo.Reference(name, true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	tag, err := repo.TagObject(ref.Hash())
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return ref.Hash(), nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	commit, err := tag.Commit()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return commit.Hash, nil
+}
+
+// hardReset is git reset --hard. go-git's HardReset also deletes untracked
+// and ignored files, so the reset is limited to the paths tracked before or
+// after it.
+func hardReset(repo *git.Repository, worktree *git.Worktree, target plumbing.Hash, stderr *output) error {
+	defer stderr.phase("checkout")()
+
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+
+	paths := make(map[string]struct{}, len(idx.Entries))
+	for _, entry := range idx.Entries {
+		paths[entry.Name] = struct{}{}
+	}
+
+	commit, err := repo.CommitObject(target)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	entries, err := flattenTree(tree)
+	if err != nil {
+		return err
+	}
+	for path := range entries {
+		paths[path] = struct{}{}
+	}
+
+	if len(paths) == 0 {
+		return worktree.Reset(&git.ResetOptions{Mode: git.SoftReset, Commit: target})
+	}
+
+	return worktree.Reset(&git.ResetOptions{
+		Mode:   git.HardReset,
+		Commit: target,
+		Files:  sortedKeys(paths),
+	})
+}
+
+// checkUntrackedOverwrite refuses to update the worktree to target when
+// untracked files sit where target has files or directories, like git does
+// before a merge. Ignored files are not protected, as in git.
+func checkUntrackedOverwrite(repo *git.Repository, worktree *git.Worktree, target plumbing.Hash) error {
+	commit, err := repo.CommitObject(target)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	entries, err := flattenTree(tree)
+	if err != nil {
+		return err
+	}
+
+	directories := make(map[string]bool)
+	for entry := range entries {
+		for dir := path.Dir(entry); dir != "."; dir = path.Dir(dir) {
+			directories[dir] = true
+		}
+	}
+
+	status, err := worktree.Status()
+	if err != nil {
+		return err
+	}
+
+	var overwritten []string
+	for name, fileStatus := range status {
+		if fileStatus.Worktree != git.Untracked {
+			continue
+		}
+		collides := directories[name]
+		for prefix := name; !collides && prefix != "."; prefix = path.Dir(prefix) {
+			_, collides = entries[prefix]
+		}
+		if collides {
+			overwritten = append(overwritten, name)
+		}
+	}
+	if len(overwritten) == 0 {
+		return nil
+	}
+	sort.Strings(overwritten)
+
+	var message strings.Builder
+	message.WriteString("The following untracked working tree files would be overwritten by merge:")
+	for _, name := range overwritten {
+		fmt.Fprintf(&message, "\n\t%s", name)
+	}
+	message.WriteString("\nPlease move or remove them before you pull.")
+
+	return &Error{
+		Code:    ExitFatal,
+		Message: message.String(),
+	}
+}
+
+// printHeadChange reports where HEAD was and where it is now, so forced
+// updates leave an audit trail in the logs.
+func printHeadChange(repo *git.Repository, from, to plumbing.Hash, stderr io.Writer) error {
+	previous, err := repo.CommitObject(from)
+	if err != nil {
+		return err
+	}
+	current, err := repo.CommitObject(to)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "HEAD was at %s %s\n", previous.Hash.String()[:7], commitSubject(previous))
+	fmt.Fprintf(stderr, "HEAD is now at %s %s\n", current.Hash.String()[:7], commitSubject(current))
+	return nil
+}
+
+// fetchUpstream fetches from the remote and returns the remote-tracking ref
+// of the checked out branch.
+func fetchUpstream(
+	ctx context.Context,
+	repo *git.Repository,
+	head *plumbing.Reference,
+	opts Options,
+	auth transport.AuthMethod,
+	stderr *output,
+) (*plumbing.Reference, error) {
+	refSpecs, err := pullRefSpecs(repo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fetchWithPrune(ctx, repo, &git.FetchOptions{
+		RemoteName: opts.RemoteName,
+		RemoteURL:  opts.fetchURL(),
+		RefSpecs:   refSpecs,
+		Depth:      opts.Depth,
+		Progress:   stderr.sideband(),
+		Auth:       auth,
+		Prune:      opts.Prune,
+	}, opts, stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamName := plumbing.NewRemoteReferenceName(opts.RemoteName, head.Name().Short())
+	upstream, err := repo.Reference(upstreamName, true)
+	if err != nil {
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return nil, &Error{
+				Code:    ExitFatal,
+				Message: fmt.Sprintf("couldn't find remote ref %s", head.Name()),
+			}
+		}
+		return nil, err
+	}
+
+	return upstream, nil
+}
+
+// integrateUpstream returns the commit the branch should point to after
+// pulling upstream into head.
+func integrateUpstream(repo *git.Repository, head, upstream *plumbing.Reference, opts Options) (plumbing.Hash, error) {
+	local, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	remote, err := repo.CommitObject(upstream.Hash())
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if local.Hash == remote.Hash {
+		return local.Hash, nil
+	}
+
+	upToDate, err := isAncestor(repo, remote, local)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if upToDate {
+		return local.Hash, nil
+	}
+
+	fastForward, err := isAncestor(repo, local, remote)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if fastForward && !(opts.PullMode == PullMerge && opts.PullNoFastForward) {
+		return remote.Hash, nil
+	}
+
+	switch opts.PullMode {
+	case PullMerge:
+		return mergeUpstream(repo, local, remote, upstream.Name(), opts)
+	case PullRebase:
+		return rebaseOnto(repo, local, remote, opts)
+	}
+
+	return plumbing.ZeroHash, &Error{
+		Code:    ExitFatal,
+		Message: "Not possible to fast-forward, aborting.",
+	}
+}
+
+// mergeUpstream creates a merge commit of local and remote like git pull
+// --no-rebase would.
+func mergeUpstream(
+	repo *git.Repository,
+	local, remote *object.Commit,
+	upstreamName plumbing.ReferenceName,
+	opts Options,
+) (plumbing.Hash, error) {
+	baseTree, err := mergeBaseTree(repo, local, remote)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	ourTree, err := local.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	theirTree, err := remote.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	tree, conflicts, err := mergeTrees(repo, baseTree, ourTree, theirTree)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if len(conflicts) > 0 {
+		return plumbing.ZeroHash, conflictError(
+			fmt.Sprintf("Automatic merge of %s failed; the branch and worktree were left untouched.", upstreamName.Short()),
+			conflicts,
+		)
+	}
+
+	author, committer := pullSignatures(opts.Config)
+	return writeCommit(repo, &object.Commit{
+		Author:       author,
+		Committer:    committer,
+		Message:      fmt.Sprintf("Merge branch '%s' of %s\n", strings.TrimPrefix(upstreamName.Short(), opts.RemoteName+"/"), opts.Repository),
+		TreeHash:     tree,
+		ParentHashes: []plumbing.Hash{local.Hash, remote.Hash},
+	})
+}
+
+// rebaseOnto replays the local commits that are not upstream on top of
+// remote, in topological order like git rebase. Merge commits are dropped
+// while the commits they brought in are replayed, and commits whose changes
+// are already upstream are skipped.
+func rebaseOnto(repo *git.Repository, local, remote *object.Commit, opts Options) (plumbing.Hash, error) {
+	upstreamHistory, err := ancestors(repo, remote)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	pending, err := localCommits(repo, local, upstreamHistory)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	_, committer := pullSignatures(opts.Config)
+	onto := remote
+	for _, commit := range pending {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		tree, conflicts, err := mergeCommitTrees(repo, parent, onto, commit)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if len(conflicts) > 0 {
+			return plumbing.ZeroHash, conflictError(
+				fmt.Sprintf("could not apply %s... %s; the branch and worktree were left untouched.", commit.Hash.String()[:7], commitSubject(commit)),
+				conflicts,
+			)
+		}
+		if tree == onto.TreeHash {
+			continue
+		}
+
+		hash, err := writeCommit(repo, &object.Commit{
+			Author:       commit.Author,
+			Committer:    committer,
+			Message:      commit.Message,
+			TreeHash:     tree,
+			ParentHashes: []plumbing.Hash{onto.Hash},
+		})
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if onto, err = repo.CommitObject(hash); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	return onto.Hash, nil
+}
+
+// localCommits lists the non-merge commits reachable from local but not in
+// upstreamHistory, parents before children.
+func localCommits(repo *git.Repository, local *object.Commit, upstreamHistory map[plumbing.Hash]struct{}) ([]*object.Commit, error) {
+	type visit struct {
+		commit *object.Commit
+		next   int
+	}
+
+	var pending []*object.Commit
+	seen := map[plumbing.Hash]bool{local.Hash: true}
+	stack := []*visit{{commit: local}}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if top.commit.NumParents() == 0 {
+			return nil, unrelatedHistoriesError()
+		}
+		if top.next == top.commit.NumParents() {
+			stack = stack[:len(stack)-1]
+			if top.commit.NumParents() == 1 {
+				pending = append(pending, top.commit)
+			}
+			continue
+		}
+
+		hash := top.commit.ParentHashes[top.next]
+		top.next++
+		if _, ok := upstreamHistory[hash]; ok || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		parent, err := repo.CommitObject(hash)
+		if err != nil {
+			if errors.Is(err, plumbing.ErrObjectNotFound) {
+				return nil, unrelatedHistoriesError()
+			}
+			return nil, err
+		}
+		stack = append(stack, &visit{commit: parent})
+	}
+
+	return pending, nil
+}
+
+func mergeCommitTrees(repo *git.Repository, base, ours, theirs *object.Commit) (plumbing.Hash, []mergeConflict, error) {
+	baseTree, err := base.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	ourTree, err := ours.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	theirTree, err := theirs.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+
+	return mergeTrees(repo, baseTree, ourTree, theirTree)
+}
+
+// mergeBaseTree returns the tree a merge of local and remote starts from.
+// Like git's recursive strategy, several best common ancestors, as in a
+// criss-cross history, are merged into a virtual base first; when that merge
+// conflicts, the most recent of them is used as it is.
+func mergeBaseTree(repo *git.Repository, local, remote *object.Commit) (*object.Tree, error) {
+	bases, err := mergeBases(repo, local, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := bases[0].Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	virtual := first
+	for _, base := range bases[1:] {
+		innerBase, err := mergeBaseTree(repo, bases[0], base)
+		if err != nil {
+			return nil, err
+		}
+		theirs, err := base.Tree()
+		if err != nil {
+			return nil, err
+		}
+
+		hash, conflicts, err := mergeTrees(repo, innerBase, virtual, theirs)
+		if err != nil {
+			return nil, err
+		}
+		if len(conflicts) > 0 {
+			return first, nil
+		}
+		if virtual, err = repo.TreeObject(hash); err != nil {
+			return nil, err
+		}
+	}
+
+	return virtual, nil
+}
+
+// mergeBases returns the best common ancestors of local and remote, the ones
+// no other common ancestor can reach, most recent first like git merge-base
+// --all. go-git's MergeBase walks the whole history, so in a shallow
+// repository, whose boundary commits lack their parents, the same walk is
+// done here stopping at the boundary.
+func mergeBases(repo *git.Repository, local, remote *object.Commit) ([]*object.Commit, error) {
+	shallows, err := repo.Storer.Shallow()
+	if err != nil {
+		return nil, err
+	}
+
+	var bases []*object.Commit
+	if len(shallows) == 0 {
+		bases, err = local.MergeBase(remote)
+	} else {
+		bases, err = shallowMergeBases(repo, local, remote, shallows)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) == 0 {
+		return nil, unrelatedHistoriesError()
+	}
+
+	return bases, nil
+}
+
+func shallowMergeBases(repo *git.Repository, local, remote *object.Commit, shallows []plumbing.Hash) ([]*object.Commit, error) {
+	remoteHistory, err := ancestors(repo, remote)
+	if err != nil {
+		return nil, err
+	}
+	boundary := make(map[plumbing.Hash]struct{}, len(shallows))
+	for _, hash := range shallows {
+		boundary[hash] = struct{}{}
+	}
+
+	var isCommon object.CommitFilter = func(commit *object.Commit) bool {
+		_, ok := remoteHistory[commit.Hash]
+		return ok
+	}
+	var isLimit object.CommitFilter = func(commit *object.Commit) bool {
+		_, ok := boundary[commit.Hash]
+		return ok || isCommon(commit)
+	}
+
+	var candidates []*object.Commit
+	err = object.NewFilterCommitIter(local, &isCommon, &isLimit).ForEach(func(commit *object.Commit) error {
+		candidates = append(candidates, commit)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var bases []*object.Commit
+	for _, candidate := range candidates {
+		best := true
+		for _, other := range candidates {
+			if other.Hash == candidate.Hash {
+				continue
+			}
+			reachable, err := isAncestor(repo, candidate, other)
+			if err != nil {
+				return nil, err
+			}
+			if reachable {
+				best = false
+				break
+			}
+		}
+		if best {
+			bases = append(bases, candidate)
+		}
+	}
+	sort.SliceStable(bases, func(i, j int) bool {
+		return bases[i].Committer.When.After(bases[j].Committer.When)
+	})
+
+	return bases, nil
+}
+
+// isAncestor reports whether ancestor is reachable from descendant. Like
+// ancestors, it stops at shallow boundaries instead of failing on their
+// missing parents.
+func isAncestor(repo *git.Repository, ancestor, descendant *object.Commit) (bool, error) {
+	ignore, err := shallowParents(repo)
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	err = object.NewCommitPreorderIter(descendant, nil, ignore).ForEach(func(commit *object.Commit) error {
+		if commit.Hash == ancestor.Hash {
+			found = true
+			return storer.ErrStop
+		}
+		return nil
+	})
+
+	return found, err
+}
+
+func ancestors(repo *git.Repository, commit *object.Commit) (map[plumbing.Hash]struct{}, error) {
+	ignore, err := shallowParents(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make(map[plumbing.Hash]struct{})
+	err = object.NewCommitPreorderIter(commit, nil, ignore).ForEach(func(commit *object.Commit) error {
+		history[commit.Hash] = struct{}{}
+		return nil
+	})
+
+	return history, err
+}
+
+// shallowParents lists the parents of the shallow commits, which are not in
+// the object store and have to be skipped when walking history.
+func shallowParents(repo *git.Repository) ([]plumbing.Hash, error) {
+	shallows, err := repo.Storer.Shallow()
+	if err != nil {
+		return nil, err
+	}
+
+	var parents []plumbing.Hash
+	for _, hash := range shallows {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			if errors.Is(err, plumbing.ErrObjectNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		parents = append(parents, commit.ParentHashes...)
+	}
+
+	return parents, nil
+}
+
+func writeCommit(repo *git.Repository, commit *object.Commit) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+// pullSignatures returns the author and committer for commits created by a
+// pull, honoring GIT_AUTHOR_*, GIT_COMMITTER_* and user.name/user.email.
+func pullSignatures(config *Config) (object.Signature, object.Signature) {
+	now := time.Now()
+	return pullSignature(config, "AUTHOR", now), pullSignature(config, "COMMITTER", now)
+}
+
+func pullSignature(config *Config, role string, when time.Time) object.Signature {
+	name := os.Getenv("GIT_" + role + "_NAME")
+	if name == "" {
+		name, _ = config.Get("user", "", "name")
+	}
+	email := os.Getenv("GIT_" + role + "_EMAIL")
+	if email == "" {
+		email, _ = config.Get("user", "", "email")
+	}
+
+	// Without a configured identity fall back to user@host, which is what
+	// git derives from the system as well.
+	if name == "" || email == "" {
+		login := "git-clone"
+		if current, err := user.Current(); err == nil && current.Username != "" {
+			login = current.Username
+		}
+		if name == "" {
+			name = login
+		}
+		if email == "" {
+			host, _ := os.Hostname()
+			if host == "" {
+				host = "localhost"
+			}
+			email = login + "@" + host
+		}
+	}
+
+	return object.Signature{Name: name, Email: email, When: when}
+}
+
+func commitSubject(commit *object.Commit) string {
+	subject, _, _ := strings.Cut(strings.TrimSpace(commit.Message), "\n")
+	return subject
+}
+
+func conflictError(summary string, conflicts []mergeConflict) error {
+	var message strings.Builder
+	message.WriteString(summary)
+	for _, conflict := range conflicts {
+		if conflict.kind == "content" || conflict.kind == "add/add" {
+			fmt.Fprintf(&message, "\nCONFLICT (%s): Merge conflict in %s", conflict.kind, conflict.path)
+			continue
+		}
+		fmt.Fprintf(&message, "\nCONFLICT (%s): %s", conflict.kind, conflict.path)
+	}
+
+	return &Error{
+		Code:    ExitFatal,
+		Message: message.String(),
+	}
+}
+
+func unrelatedHistoriesError() error {
+	return &Error{
+		Code:    ExitFatal,
+		Message: "refusing to merge unrelated histories",
+	}
+}
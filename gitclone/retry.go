@@ -0,0 +1,175 @@
+package gitclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// retryBaseDelay is the backoff before the first retry. It doubles with
+// every further retry up to retryMaxDelay, and a random part of up to half
+// of it is dropped so that clients failing together do not retry together.
+var (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+// transientStatus are the HTTP statuses a forge answers with while it is
+// overloaded or restarting.
+var transientStatus = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// withRetries runs attempt, and again up to opts.Retries times while it
+// fails with a transient error, waiting for the backoff or the server's
+// Retry-After in between. reset, when set, runs before every retry to undo
+// what the failed attempt left behind. what names the attempt in the
+// warnings.
+func withRetries(ctx context.Context, opts Options, stderr *output, what string, attempt func() error, reset func()) error {
+	for retry := 1; ; retry++ {
+		err := attempt()
+		if err == nil || retry > opts.Retries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+
+		delay, ok := retryAfter(err)
+		if !ok {
+			delay = backoff(retry)
+		}
+		if !opts.Quiet {
+			fmt.Fprintf(stderr, "warning: %s failed: %s\n", what, err)
+			fmt.Fprintf(stderr, "warning: retrying in %s (%d of %d)\n", delay.Round(time.Millisecond), retry, opts.Retries)
+		}
+		stderr.traces.general.printf("trace: retry: %s after %s: %s", what, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if reset != nil {
+			reset()
+		}
+	}
+}
+
+// backoff is the delay before the given retry, counting from 1.
+func backoff(retry int) time.Duration {
+	delay := retryMaxDelay
+	if shift := retry - 1; shift < 16 && retryBaseDelay<<shift < retryMaxDelay {
+		delay = retryBaseDelay << shift
+	}
+	if delay <= 1 {
+		return delay
+	}
+
+	return delay - rand.N(delay/2)
+}
+
+// isTransient tells the failures that may go away by themselves, such as
+// overloaded servers and dropped connections, from the ones that will not,
+// such as missing repositories, rejected credentials or errors git reports
+// as fatal. A plain io.EOF is not one of them: it is also how a server that
+// closes the connection on purpose, say after rejecting an SSH key, shows.
+func isTransient(err error) bool {
+	var gitErr *Error
+	if errors.As(err, &gitErr) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if status, ok := httpError(err); ok {
+		return transientStatus[status.StatusCode()]
+	}
+
+	cause := unwrapTransportError(err)
+	var netErr net.Error
+	switch {
+	case errors.Is(cause, syscall.ECONNRESET),
+		errors.Is(cause, syscall.ECONNREFUSED),
+		errors.Is(cause, syscall.ECONNABORTED),
+		errors.Is(cause, syscall.EPIPE),
+		errors.Is(cause, io.ErrUnexpectedEOF),
+		errors.As(cause, &netErr) && netErr.Timeout():
+		return true
+	}
+
+	// Some go-git paths only keep the message of the error they got.
+	message := err.Error()
+	for _, text := range []string{"connection reset by peer", "broken pipe", "unexpected EOF"} {
+		if strings.Contains(message, text) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryAfter reads the Retry-After header of a failed HTTP request, in
+// seconds or as a date. A server asking for more than retryMaxDelay gets
+// retryMaxDelay, so it cannot stall the run indefinitely.
+func retryAfter(err error) (time.Duration, bool) {
+	status, ok := httpError(err)
+	if !ok || status.Response == nil {
+		return 0, false
+	}
+
+	value := strings.TrimSpace(status.Response.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		if seconds > int(retryMaxDelay/time.Second) {
+			return retryMaxDelay, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return min(max(time.Until(date), 0), retryMaxDelay), true
+	}
+
+	return 0, false
+}
+
+func httpError(err error) (*githttp.Err, bool) {
+	var status *githttp.Err
+	if errors.As(unwrapTransportError(err), &status) {
+		return status, true
+	}
+
+	return nil, false
+}
+
+// unwrapTransportError looks through go-git's UnexpectedError and
+// PermanentError, which hide the error they wrap from errors.As.
+func unwrapTransportError(err error) error {
+	for {
+		var unexpected *plumbing.UnexpectedError
+		var permanent *plumbing.PermanentError
+		switch {
+		case errors.As(err, &unexpected):
+			err = unexpected.Err
+		case errors.As(err, &permanent):
+			err = permanent.Err
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package gitclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// infiniteDepth is what git fetch --unshallow asks for.
+const infiniteDepth = 0x7fffffff
+
+// deepenRequested reports whether --deepen, --unshallow or --shallow-since
+// asks --pull to extend the history of a shallow repository.
+func (opts Options) deepenRequested() bool {
+	return opts.Deepen > 0 || opts.Unshallow || !opts.ShallowSince.IsZero()
+}
+
+// deepenOption names the option deepenRequested found, for messages.
+func (opts Options) deepenOption() string {
+	switch {
+	case opts.Deepen > 0:
+		return "--deepen"
+	case opts.Unshallow:
+		return "--unshallow"
+	}
+	return "--shallow-since"
+}
+
+// deepenHistory extends the history of a shallow repository before the
+// regular pull runs. go-git only knows absolute depths and never drops
+// commits from the shallow file, so the upload-pack request is sent here
+// and the shallow file is rewritten from the server's shallow and unshallow
+// lines, like git fetch-pack does. A complete repository has nothing to
+// deepen.
+func deepenHistory(ctx context.Context, repo *git.Repository, opts Options, auth transport.AuthMethod, stderr *output) error {
+	shallows, err := repo.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+	if len(shallows) == 0 {
+		if opts.Unshallow {
+			return &Error{
+				Code:    ExitFatal,
+				Message: "--unshallow on a complete repository does not make sense",
+			}
+		}
+		return nil
+	}
+	defer stderr.phase("deepen")()
+
+	endpoint, err := transport.NewEndpoint(opts.fetchURL())
+	if err != nil {
+		return err
+	}
+	transportClient, auth, err := sessionTransport(endpoint, auth)
+	if err != nil {
+		return err
+	}
+	session, err := transportClient.NewUploadPackSession(endpoint, auth)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	advertised, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			return nil
+		}
+		return err
+	}
+
+	req := packp.NewUploadPackRequestFromCapabilities(advertised.Capabilities)
+	if err := setDeepenRequest(req, advertised.Capabilities, opts); err != nil {
+		return err
+	}
+	req.Shallows = shallows
+
+	req.Wants, err = deepenWants(repo, opts, advertised)
+	if err != nil {
+		return err
+	}
+	if len(req.Wants) == 0 {
+		return nil
+	}
+	req.Haves, err = localCommitHashes(repo)
+	if err != nil {
+		return err
+	}
+
+	response, err := session.UploadPack(ctx, req)
+	if err != nil {
+		if errors.Is(err, transport.ErrEmptyUploadPackRequest) {
+			return nil
+		}
+		return err
+	}
+	defer response.Close()
+
+	pack := io.Reader(response)
+	if t, ok := sidebandType(req.Capabilities); ok {
+		demuxer := sideband.NewDemuxer(t, response)
+		demuxer.Progress = stderr.sideband()
+		pack = demuxer
+	}
+	if err := packfile.UpdateObjectStorage(repo.Storer, pack); err != nil {
+		return err
+	}
+
+	return setShallows(repo, updatedShallows(shallows, response.ShallowUpdate))
+}
+
+// setShallows rewrites the shallow file. git treats an empty one as shallow
+// still, so it is removed once the history is complete.
+func setShallows(repo *git.Repository, shallows []plumbing.Hash) error {
+	if storage, ok := repo.Storer.(*filesystem.Storage); ok && len(shallows) == 0 {
+		err := storage.Filesystem().Remove("shallow")
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	return repo.Storer.SetShallow(shallows)
+}
+
+// setDeepenRequest fills in the deepen line for the requested option,
+// refusing servers that cannot honor it like git does.
+func setDeepenRequest(req *packp.UploadPackRequest, advertised *capability.List, opts Options) error {
+	required := capability.Shallow
+	option := "shallow clients"
+	switch {
+	case opts.Deepen > 0:
+		required, option = capability.DeepenRelative, "--deepen"
+	case !opts.ShallowSince.IsZero():
+		required, option = capability.DeepenSince, "--shallow-since"
+	}
+	for _, c := range []capability.Capability{capability.Shallow, required} {
+		if !advertised.Supports(c) {
+			return &Error{
+				Code:    ExitFatal,
+				Message: fmt.Sprintf("Server does not support %s", option),
+			}
+		}
+		if err := req.Capabilities.Set(c); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case opts.Unshallow:
+		req.Depth = packp.DepthCommits(infiniteDepth)
+	case opts.Deepen > 0:
+		req.Depth = packp.DepthCommits(opts.Deepen)
+	default:
+		req.Depth = packp.DepthSince(opts.ShallowSince)
+	}
+
+	return nil
+}
+
+// deepenWants are the advertised refs this repository follows: those matched
+// by the remote's fetch refspecs, the tags it already has and the -b target.
+func deepenWants(repo *git.Repository, opts Options, advertised *packp.AdvRefs) ([]plumbing.Hash, error) {
+	refSpecs, err := pullRefSpecs(repo, opts)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := advertised.AllReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []plumbing.ReferenceName
+	if opts.Branch != "" {
+		targets = append(branchCandidates(opts.Branch), tagCandidates(opts.Branch)...)
+	}
+
+	seen := make(map[plumbing.Hash]struct{})
+	var wants []plumbing.Hash
+	for name, ref := range refs {
+		if ref.Type() != plumbing.HashReference {
+			continue
+		}
+
+		wanted := false
+		for _, refSpec := range refSpecs {
+			if refSpec.Match(name) {
+				wanted = true
+				break
+			}
+		}
+		for _, target := range targets {
+			wanted = wanted || target == name
+		}
+		if !wanted && name.IsTag() {
+			if _, err := repo.Storer.Reference(name); err == nil {
+				wanted = true
+			}
+		}
+
+		if _, ok := seen[ref.Hash()]; wanted && !ok {
+			seen[ref.Hash()] = struct{}{}
+			wants = append(wants, ref.Hash())
+		}
+	}
+
+	return wants, nil
+}
+
+// localCommitHashes lists the commits local refs point at, which is what
+// the request advertises as haves.
+func localCommitHashes(repo *git.Repository) ([]plumbing.Hash, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[plumbing.Hash]struct{})
+	var haves []plumbing.Hash
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		if _, ok := seen[ref.Hash()]; ok {
+			return nil
+		}
+		if _, err := repo.CommitObject(ref.Hash()); err != nil {
+			return nil
+		}
+		seen[ref.Hash()] = struct{}{}
+		haves = append(haves, ref.Hash())
+		return nil
+	})
+
+	return haves, err
+}
+
+func sidebandType(capabilities *capability.List) (sideband.Type, bool) {
+	switch {
+	case capabilities.Supports(capability.Sideband64k):
+		return sideband.Sideband64k, true
+	case capabilities.Supports(capability.Sideband):
+		return sideband.Sideband, true
+	}
+
+	return 0, false
+}
+
+// updatedShallows applies the server's shallow update to the current list:
+// commits whose parents arrived are dropped and the new boundary is added.
+func updatedShallows(current []plumbing.Hash, update packp.ShallowUpdate) []plumbing.Hash {
+	unshallowed := make(map[plumbing.Hash]struct{}, len(update.Unshallows))
+	for _, hash := range update.Unshallows {
+		unshallowed[hash] = struct{}{}
+	}
+
+	seen := make(map[plumbing.Hash]struct{})
+	var result []plumbing.Hash
+	for _, hash := range append(append([]plumbing.Hash(nil), current...), update.Shallows...) {
+		if _, ok := unshallowed[hash]; ok {
+			continue
+		}
+		if _, ok := seen[hash]; ok {
+			continue
+		}
+		seen[hash] = struct{}{}
+		result = append(result, hash)
+	}
+
+	return result
+}
@@ -0,0 +1,251 @@
+package gitclone
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+// cloneStats collects the Stats of a run when Options.Stats asks for them;
+// a nil *cloneStats collects nothing.
+type cloneStats struct {
+	mu                sync.Mutex
+	refsAdvertised    int
+	advertised        bool
+	objectsBefore     int64
+	filesCheckedOut   int64
+	submodules        int
+	submodulesUpdated int
+	phases            []PhaseTiming
+}
+
+// PhaseTiming is how long one phase of the run took in total. The phases
+// are ls-remote, fetch, checkout, submodules and write config, in the order
+// they first ran.
+type PhaseTiming struct {
+	Name       string  `json:"name"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Stats counts what a run transferred and wrote, and how long it took.
+// ObjectsReceived and PackBytes come from the pack indexes and packs of the
+// destination, FilesCheckedOut is what this run wrote to the worktree and
+// WorktreeFiles and WorktreeBytes are what the worktree holds afterwards.
+type Stats struct {
+	RefsAdvertised    int           `json:"refs_advertised"`
+	ObjectsReceived   int64         `json:"objects_received"`
+	PackBytes         int64         `json:"pack_bytes"`
+	FilesCheckedOut   int64         `json:"files_checked_out"`
+	WorktreeFiles     int64         `json:"worktree_files"`
+	WorktreeBytes     int64         `json:"worktree_bytes"`
+	Submodules        int           `json:"submodules"`
+	SubmodulesUpdated int           `json:"submodules_updated"`
+	Phases            []PhaseTiming `json:"phases"`
+	DurationMS        float64       `json:"duration_ms"`
+}
+
+// begin notes what the object store of destination already holds, so that
+// a pull only counts the objects it received.
+func (s *cloneStats) begin(destination string) {
+	if s == nil {
+		return
+	}
+
+	s.objectsBefore = packObjectCount(packDirs(destination))
+}
+
+func (s *cloneStats) addPhase(name string, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := float64(elapsed) / float64(time.Millisecond)
+	for i := range s.phases {
+		if s.phases[i].Name == name {
+			s.phases[i].DurationMS += ms
+			return
+		}
+	}
+	s.phases = append(s.phases, PhaseTiming{Name: name, DurationMS: ms})
+}
+
+// addAdvertisement counts the refs the remote advertised first, which is the
+// superproject's; submodules advertise their own later.
+func (s *cloneStats) addAdvertisement(refs *packp.AdvRefs) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.advertised {
+		return
+	}
+	s.advertised = true
+	s.refsAdvertised = len(refs.References)
+	if refs.Head != nil {
+		s.refsAdvertised++
+	}
+}
+
+func (s *cloneStats) addSubmodule(updated bool) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.submodules++
+	if updated {
+		s.submodulesUpdated++
+	}
+}
+
+// countCheckouts makes worktree count the files and symlinks it writes.
+func (s *cloneStats) countCheckouts(worktree *git.Worktree) {
+	if s == nil {
+		return
+	}
+
+	worktree.Filesystem = &countingFilesystem{Filesystem: worktree.Filesystem, created: func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.filesCheckedOut++
+	}}
+}
+
+// report sums up a successful run into repo at destination.
+func (s *cloneStats) report(repo *git.Repository, destination string, started time.Time) (*Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dirs := packDirs(destination)
+	report := &Stats{
+		RefsAdvertised:    s.refsAdvertised,
+		ObjectsReceived:   max(packObjectCount(dirs)-s.objectsBefore, 0),
+		PackBytes:         packSize(dirs),
+		FilesCheckedOut:   s.filesCheckedOut,
+		Submodules:        s.submodules,
+		SubmodulesUpdated: s.submodulesUpdated,
+		Phases:            append([]PhaseTiming{}, s.phases...),
+		DurationMS:        float64(time.Since(started)) / float64(time.Millisecond),
+	}
+
+	if _, err := repo.Worktree(); err == nil {
+		if report.WorktreeFiles, report.WorktreeBytes, err = worktreeSize(destination); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, git.ErrIsBareRepository) {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// packDirs are where the packs of destination live, for a repository with a
+// worktree and a bare one.
+func packDirs(destination string) []string {
+	return []string{
+		filepath.Join(destination, git.GitDirName, "objects", "pack"),
+		filepath.Join(destination, "objects", "pack"),
+	}
+}
+
+// packSize adds up the size of the files in dirs.
+func packSize(dirs []string) int64 {
+	var size int64
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+				size += info.Size()
+			}
+		}
+	}
+
+	return size
+}
+
+// packObjectCount adds up the objects in the pack indexes in dirs. The last
+// entry of an index's fan-out table is its object count, so only that is
+// read.
+func packObjectCount(dirs []string) int64 {
+	var count int64
+	for _, dir := range dirs {
+		indexes, _ := filepath.Glob(filepath.Join(dir, "*.idx"))
+		for _, index := range indexes {
+			count += int64(indexObjectCount(index))
+		}
+	}
+
+	return count
+}
+
+func indexObjectCount(path string) uint32 {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	// Version 2 indexes start with a magic number and the version before
+	// the 256 fan-out entries.
+	header := make([]byte, 8+256*4)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return 0
+	}
+	if string(header[:4]) != "\xfftOc" || binary.BigEndian.Uint32(header[4:8]) != 2 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(header[len(header)-4:])
+}
+
+// worktreeSize counts the files and symlinks under root and the bytes of
+// the files, leaving out the git directories of the repository and its
+// submodules.
+func worktreeSize(root string) (int64, int64, error) {
+	var files, size int64
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Name() == git.GitDirName {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		files++
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return files, size, err
+}
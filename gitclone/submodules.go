@@ -0,0 +1,375 @@
+package gitclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// updateSubmodules initializes and checks out the submodules of repo,
+// recursing until depth is exhausted. It replaces go-git's built-in
+// recursion so that submodule URLs go through the same insteadOf rewriting
+// as the superproject, and so that a pull behaves like git submodule sync
+// followed by git submodule update --init: URLs changed in .gitmodules are
+// copied into the configuration of initialized submodules, and submodules
+// already at the recorded commit are left alone. prefix is the path of repo
+// inside the top-level worktree, used in messages.
+func updateSubmodules(
+	ctx context.Context,
+	repo *git.Repository,
+	opts Options,
+	auth transport.AuthMethod,
+	depth git.SubmoduleRescursivity,
+	prefix string,
+	stderr *output,
+) error {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		if errors.Is(err, git.ErrIsBareRepository) {
+			return nil
+		}
+		return err
+	}
+
+	submodules, err := worktree.Submodules()
+	if err != nil {
+		return err
+	}
+	modules, err := readGitmodules(worktree)
+	if err != nil {
+		return err
+	}
+
+	for _, submodule := range submodules {
+		submoduleConfig := submodule.Config()
+		declared, ok := modules.Submodules[submoduleConfig.Name]
+		if !ok {
+			continue
+		}
+		url, err := resolveSubmoduleURL(repo, opts, declared.URL)
+		if err != nil {
+			return err
+		}
+
+		initialized := isInitializedSubmodule(repo, submoduleConfig.Name)
+		status, err := submodule.Status()
+		if err != nil {
+			return err
+		}
+		if initialized && submoduleConfig.URL != url {
+			if err := syncSubmoduleURL(repo, submodule, url); err != nil {
+				return err
+			}
+			if !opts.Quiet {
+				fmt.Fprintf(stderr, "Synchronizing submodule url for '%s'\n", prefix+submoduleConfig.Path)
+			}
+		}
+		submoduleConfig.URL = url
+
+		update := !initialized || status.Current.IsZero() || status.Current != status.Expected
+		event := SubmoduleEvent{
+			Event:  "submodule",
+			Path:   prefix + submoduleConfig.Path,
+			URL:    ScrubURL(url),
+			Status: "up-to-date",
+		}
+		if update {
+			event.Status = "updating"
+		}
+		if !status.Expected.IsZero() {
+			event.Commit = status.Expected.String()
+		}
+		if stderr.progress != nil {
+			stderr.progress.ReportSubmodule(event)
+		}
+		stderr.stats.addSubmodule(update)
+
+		if update {
+			updateOptions := &git.SubmoduleUpdateOptions{
+				Init:    true,
+				NoFetch: initialized && hasSubmoduleCommit(submodule, status),
+				Auth:    auth,
+			}
+			if opts.ShallowSubmodules {
+				updateOptions.Depth = 1
+			}
+
+			what := fmt.Sprintf("update of submodule '%s'", prefix+submoduleConfig.Path)
+			err := withRetries(ctx, opts, stderr, what, func() error {
+				return submodule.UpdateContext(ctx, updateOptions)
+			}, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		if depth == git.NoRecurseSubmodules {
+			continue
+		}
+
+		submoduleRepo, err := submodule.Repository()
+		if err != nil {
+			return err
+		}
+		submodulePrefix := prefix + submoduleConfig.Path + "/"
+		if !status.Current.IsZero() && status.Current != status.Expected && !opts.Quiet {
+			if err := warnOrphanedSubmodules(submoduleRepo, status.Current, status.Expected, submodulePrefix, stderr); err != nil {
+				return err
+			}
+		}
+		if err := updateSubmodules(ctx, submoduleRepo, opts, auth, depth-1, submodulePrefix, stderr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readGitmodules(worktree *git.Worktree) (*config.Modules, error) {
+	modules := config.NewModules()
+
+	content, err := readWorktreeFile(worktree, ".gitmodules")
+	if errors.Is(err, os.ErrNotExist) {
+		return modules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return modules, modules.Unmarshal(content)
+}
+
+func readWorktreeFile(worktree *git.Worktree, name string) ([]byte, error) {
+	file, err := worktree.Filesystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+func isInitializedSubmodule(repo *git.Repository, name string) bool {
+	cfg, err := repo.Config()
+	if err != nil {
+		return false
+	}
+
+	_, ok := cfg.Submodules[name]
+	return ok
+}
+
+// resolveSubmoduleURL is the URL a submodule is fetched from: relative URLs
+// are resolved against the superproject's remote like git does, and the
+// result goes through insteadOf rewriting.
+func resolveSubmoduleURL(repo *git.Repository, opts Options, rawURL string) (string, error) {
+	if !strings.HasPrefix(rawURL, "./") && !strings.HasPrefix(rawURL, "../") {
+		return opts.Config.FetchURL(rawURL), nil
+	}
+
+	remote, err := repo.Remote(opts.RemoteName)
+	if errors.Is(err, git.ErrRemoteNotFound) {
+		remote, err = repo.Remote(git.DefaultRemoteName)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(remote.Config().URLs) == 0 {
+		return "", fmt.Errorf("remote %q has no configured URL", remote.Config().Name)
+	}
+
+	endpoint, err := transport.NewEndpoint(remote.Config().URLs[0])
+	if err != nil {
+		return "", err
+	}
+	endpoint.Path = path.Join(endpoint.Path, rawURL)
+	if endpoint.Protocol == "file" {
+		return opts.Config.FetchURL(endpoint.Path), nil
+	}
+
+	return opts.Config.FetchURL(endpoint.String()), nil
+}
+
+// syncSubmoduleURL does what git submodule sync does for one submodule: the
+// superproject's submodule.<name>.url and the origin of the checked out
+// submodule are both repointed to url.
+func syncSubmoduleURL(repo *git.Repository, submodule *git.Submodule, url string) error {
+	name := submodule.Config().Name
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	if entry, ok := cfg.Submodules[name]; ok {
+		entry.URL = url
+		if err := repo.SetConfig(cfg); err != nil {
+			return err
+		}
+	}
+
+	submoduleRepo, err := submodule.Repository()
+	if err != nil {
+		return err
+	}
+	submoduleCfg, err := submoduleRepo.Config()
+	if err != nil {
+		return err
+	}
+	if remote, ok := submoduleCfg.Remotes[git.DefaultRemoteName]; ok {
+		remote.URLs = []string{url}
+		return submoduleRepo.SetConfig(submoduleCfg)
+	}
+
+	return nil
+}
+
+// hasSubmoduleCommit reports whether the commit recorded in the superproject
+// is already in the submodule's object store, so the update can skip the
+// fetch.
+func hasSubmoduleCommit(submodule *git.Submodule, status *git.SubmoduleStatus) bool {
+	if status.Expected.IsZero() {
+		return false
+	}
+
+	submoduleRepo, err := submodule.Repository()
+	if err != nil {
+		return false
+	}
+
+	_, err = submoduleRepo.CommitObject(status.Expected)
+	return err == nil
+}
+
+// warnOrphanedSubmodules reports submodules that were dropped between the
+// before and after commits of repo but whose directories are still on disk.
+// Like git, the directories are not deleted, as they may hold local work.
+func warnOrphanedSubmodules(repo *git.Repository, before, after plumbing.Hash, prefix string, stderr io.Writer) error {
+	previous, err := submodulePaths(repo, before)
+	if err != nil {
+		return err
+	}
+	current, err := submodulePaths(repo, after)
+	if err != nil {
+		return err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	root := worktree.Filesystem.Root()
+
+	var orphaned []string
+	for submodulePath := range previous {
+		if _, ok := current[submodulePath]; ok {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(submodulePath)))
+		if err == nil && len(entries) > 0 {
+			orphaned = append(orphaned, submodulePath)
+		}
+	}
+	sort.Strings(orphaned)
+	for _, submodulePath := range orphaned {
+		fmt.Fprintf(stderr, "warning: submodule '%s' was removed upstream; its directory was left in place\n", prefix+submodulePath)
+	}
+
+	return nil
+}
+
+// submodulePaths returns the gitlinks recorded in the tree of commit.
+func submodulePaths(repo *git.Repository, commit plumbing.Hash) (map[string]struct{}, error) {
+	paths := make(map[string]struct{})
+	if commit.IsZero() {
+		return paths, nil
+	}
+
+	c, err := repo.CommitObject(commit)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := flattenTree(tree)
+	if err != nil {
+		return nil, err
+	}
+	for entryPath, entry := range entries {
+		if entry.mode == filemode.Submodule {
+			paths[entryPath] = struct{}{}
+		}
+	}
+
+	return paths, nil
+}
+
+// keepRemovedSubmodules runs update, which moves the worktree from one
+// commit to another, without losing the checkouts of submodules the new
+// commit drops: go-git deletes a removed gitlink's directory with everything
+// in it, while git leaves it alone. The directories are parked next to the
+// worktree for the duration of the update and then put back; not inside
+// .git, which is a file in submodules and linked worktrees.
+func keepRemovedSubmodules(repo *git.Repository, worktree *git.Worktree, from, to plumbing.Hash, update func() error) (err error) {
+	previous, err := submodulePaths(repo, from)
+	if err != nil {
+		return err
+	}
+	current, err := submodulePaths(repo, to)
+	if err != nil {
+		return err
+	}
+
+	root := worktree.Filesystem.Root()
+	parked := make(map[string]string)
+	defer func() {
+		for submodulePath, parkedPath := range parked {
+			target := filepath.Join(root, filepath.FromSlash(submodulePath))
+			restoreErr := os.MkdirAll(filepath.Dir(target), 0o755)
+			if restoreErr == nil {
+				restoreErr = os.Rename(parkedPath, target)
+			}
+			if restoreErr == nil {
+				restoreErr = os.Remove(filepath.Dir(parkedPath))
+			}
+			if err == nil {
+				err = restoreErr
+			}
+		}
+	}()
+
+	for submodulePath := range previous {
+		if _, ok := current[submodulePath]; ok {
+			continue
+		}
+		source := filepath.Join(root, filepath.FromSlash(submodulePath))
+		if _, statErr := os.Stat(source); statErr != nil {
+			continue
+		}
+
+		parkDir, err := os.MkdirTemp(filepath.Dir(root), "."+filepath.Base(root)+"-removed-submodule-")
+		if err != nil {
+			return err
+		}
+		parkedPath := filepath.Join(parkDir, "worktree")
+		if err := os.Rename(source, parkedPath); err != nil {
+			return err
+		}
+		parked[submodulePath] = parkedPath
+	}
+
+	return update()
+}
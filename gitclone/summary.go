@@ -0,0 +1,269 @@
+package gitclone
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// diffstatWidth is the line width git uses for a diffstat when stderr is
+// not a terminal.
+const diffstatWidth = 80
+
+// printUpdateSummary reports that HEAD moved from one commit to another like
+// git pull does: the range and whether it was a fast-forward, or the merge
+// that was made, then a diffstat and, when verbose, a shortlog of the
+// commits that came in.
+func printUpdateSummary(repo *git.Repository, from, to plumbing.Hash, merged, verbose bool, stderr io.Writer) error {
+	previous, err := repo.CommitObject(from)
+	if err != nil {
+		return err
+	}
+	current, err := repo.CommitObject(to)
+	if err != nil {
+		return err
+	}
+
+	if merged {
+		fmt.Fprintln(stderr, "Merge made by the 'recursive' strategy.")
+	} else {
+		fmt.Fprintf(stderr, "Updating %s..%s\n", from.String()[:7], to.String()[:7])
+		fastForward, err := isAncestor(repo, previous, current)
+		if err != nil {
+			return err
+		}
+		if fastForward {
+			fmt.Fprintln(stderr, "Fast-forward")
+		}
+	}
+
+	if err := writeDiffstat(repo, previous, current, stderr); err != nil {
+		return err
+	}
+	if verbose {
+		return writeShortlog(repo, previous, current, stderr)
+	}
+
+	return nil
+}
+
+// fileStat is one line of a diffstat.
+type fileStat struct {
+	name     string
+	added    int
+	deleted  int
+	binary   bool
+	oldSize  int
+	newSize  int
+	oldEntry treeEntry
+	newEntry treeEntry
+	inOld    bool
+	inNew    bool
+}
+
+// writeDiffstat writes git's --stat --summary output for the change between
+// two commits.
+func writeDiffstat(repo *git.Repository, from, to *object.Commit, w io.Writer) error {
+	stats, err := diffStats(repo, from, to)
+	if err != nil || len(stats) == 0 {
+		return err
+	}
+
+	nameWidth, numberWidth, maxChange := 0, 0, 0
+	for _, stat := range stats {
+		nameWidth = max(nameWidth, len(stat.name))
+		if stat.binary {
+			numberWidth = max(numberWidth, len("Bin"))
+			continue
+		}
+		total := stat.added + stat.deleted
+		numberWidth = max(numberWidth, len(strconv.Itoa(total)))
+		maxChange = max(maxChange, total)
+	}
+	graphWidth := max(diffstatWidth-nameWidth-numberWidth-5, 6)
+
+	insertions, deletions := 0, 0
+	for _, stat := range stats {
+		if stat.binary {
+			fmt.Fprintf(w, " %-*s | Bin %d -> %d bytes\n", nameWidth, stat.name, stat.oldSize, stat.newSize)
+			continue
+		}
+
+		added, deleted := stat.added, stat.deleted
+		if maxChange > graphWidth {
+			added = scaleStat(added, graphWidth, maxChange)
+			deleted = scaleStat(deleted, graphWidth, maxChange)
+		}
+		graph := strings.Repeat("+", added) + strings.Repeat("-", deleted)
+		line := fmt.Sprintf(" %-*s | %*d %s", nameWidth, stat.name, numberWidth, stat.added+stat.deleted, graph)
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+
+		insertions += stat.added
+		deletions += stat.deleted
+	}
+
+	summary := fmt.Sprintf(" %d %s changed", len(stats), plural(len(stats), "file", "files"))
+	if insertions > 0 || deletions == 0 {
+		summary += fmt.Sprintf(", %d %s(+)", insertions, plural(insertions, "insertion", "insertions"))
+	}
+	if deletions > 0 || insertions == 0 {
+		summary += fmt.Sprintf(", %d %s(-)", deletions, plural(deletions, "deletion", "deletions"))
+	}
+	fmt.Fprintln(w, summary)
+
+	for _, stat := range stats {
+		switch {
+		case !stat.inOld:
+			fmt.Fprintf(w, " create mode %06o %s\n", uint32(stat.newEntry.mode), stat.name)
+		case !stat.inNew:
+			fmt.Fprintf(w, " delete mode %06o %s\n", uint32(stat.oldEntry.mode), stat.name)
+		case stat.oldEntry.mode != stat.newEntry.mode:
+			fmt.Fprintf(w, " mode change %06o => %06o %s\n", uint32(stat.oldEntry.mode), uint32(stat.newEntry.mode), stat.name)
+		}
+	}
+
+	return nil
+}
+
+func diffStats(repo *git.Repository, from, to *object.Commit) ([]fileStat, error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+	before, err := flattenTree(fromTree)
+	if err != nil {
+		return nil, err
+	}
+	after, err := flattenTree(toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]struct{}, len(before)+len(after))
+	for path := range before {
+		paths[path] = struct{}{}
+	}
+	for path := range after {
+		paths[path] = struct{}{}
+	}
+
+	var stats []fileStat
+	for _, path := range sortedKeys(paths) {
+		stat := fileStat{name: path}
+		stat.oldEntry, stat.inOld = before[path]
+		stat.newEntry, stat.inNew = after[path]
+		if stat.inOld && stat.inNew && stat.oldEntry == stat.newEntry {
+			continue
+		}
+
+		var oldContent, newContent []byte
+		if stat.inOld {
+			if oldContent, err = statContent(repo, stat.oldEntry); err != nil {
+				return nil, err
+			}
+		}
+		if stat.inNew {
+			if newContent, err = statContent(repo, stat.newEntry); err != nil {
+				return nil, err
+			}
+		}
+
+		if isBinary(oldContent) || isBinary(newContent) {
+			stat.binary = true
+			stat.oldSize, stat.newSize = len(oldContent), len(newContent)
+		} else if stat.oldEntry.hash != stat.newEntry.hash {
+			for _, hunk := range diffLines(splitLines(string(oldContent)), splitLines(string(newContent))) {
+				stat.added += len(hunk.lines)
+				stat.deleted += hunk.end - hunk.start
+			}
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+// statContent is what a diffstat compares for an entry; submodules are
+// shown as the commit they point at, like git does.
+func statContent(repo *git.Repository, entry treeEntry) ([]byte, error) {
+	if entry.mode == filemode.Submodule {
+		return []byte("Subproject commit " + entry.hash.String() + "\n"), nil
+	}
+
+	return readBlob(repo, entry.hash)
+}
+
+func scaleStat(value, width, maxChange int) int {
+	if value == 0 {
+		return 0
+	}
+
+	return 1 + value*(width-1)/maxChange
+}
+
+func plural(count int, singular, many string) string {
+	if count == 1 {
+		return singular
+	}
+
+	return many
+}
+
+// writeShortlog lists the commits reachable from to but not from, grouped by
+// author like git shortlog.
+func writeShortlog(repo *git.Repository, from, to *object.Commit, w io.Writer) error {
+	history, err := ancestors(repo, from)
+	if err != nil {
+		return err
+	}
+	known := make(map[plumbing.Hash]bool, len(history))
+	for hash := range history {
+		known[hash] = true
+	}
+	ignore, err := shallowParents(repo)
+	if err != nil {
+		return err
+	}
+
+	var commits []*object.Commit
+	err = object.NewCommitPreorderIter(to, known, ignore).ForEach(func(commit *object.Commit) error {
+		commits = append(commits, commit)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	subjects := make(map[string][]string)
+	for i := len(commits) - 1; i >= 0; i-- {
+		author := commits[i].Author.Name
+		subjects[author] = append(subjects[author], commitSubject(commits[i]))
+	}
+
+	authors := make([]string, 0, len(subjects))
+	for author := range subjects {
+		authors = append(authors, author)
+	}
+	sort.Strings(authors)
+	for _, author := range authors {
+		fmt.Fprintf(w, "%s (%d):\n", author, len(subjects[author]))
+		for _, subject := range subjects[author] {
+			fmt.Fprintf(w, "      %s\n", subject)
+		}
+		fmt.Fprintln(w)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package gitclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errRunTimeout is the cause of a run canceled by Options.Timeout.
+var errRunTimeout = errors.New("run timed out")
+
+// transferPhases are the phases that receive objects, which the low-speed
+// limit applies to.
+var transferPhases = map[string]bool{"fetch": true, "deepen": true}
+
+// timeOut records that a limit ended the run, naming the phase that was
+// running, and cancels the run. Only the first limit hit is kept.
+func (o *output) timeOut(format string, args ...any) {
+	phase := o.currentPhase()
+	o.mu.Lock()
+	if o.timedOut == "" {
+		o.timedOut = fmt.Sprintf(format, args...)
+		if phase != "" {
+			o.timedOut += " during " + phase
+		}
+	}
+	o.mu.Unlock()
+
+	if o.cancel != nil {
+		o.cancel()
+	}
+}
+
+// currentPhase is the innermost phase that is running, empty outside of
+// them.
+func (o *output) currentPhase() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.phases) == 0 {
+		return ""
+	}
+
+	return o.phases[len(o.phases)-1]
+}
+
+func (o *output) timeoutMessage() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.timedOut
+}
+
+// watchTimeout records the phase that runs when ctx reaches the timeout of
+// the run. The returned function stops watching, and waits for the record
+// if the timeout already fired.
+func (o *output) watchTimeout(ctx context.Context, timeout time.Duration) func() {
+	recorded := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(recorded)
+		if context.Cause(ctx) == errRunTimeout {
+			o.timeOut("timed out after %s", timeout)
+		}
+	})
+
+	return func() {
+		if !stop() {
+			<-recorded
+		}
+	}
+}
+
+// connectTimeoutError is a connection that did not answer within the
+// connect timeout, named with the phase that was running. Unlike the limits
+// of the run it only fails the attempt, so a retry may connect again.
+type connectTimeoutError struct {
+	message string
+	err     error
+}
+
+func (e *connectTimeoutError) Error() string {
+	return e.message
+}
+
+func (e *connectTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// Timeout reports a timeout to net/http, whose url.Error asks the error it
+// wraps.
+func (e *connectTimeoutError) Timeout() bool {
+	return true
+}
+
+// connectTimeout wraps err, the failure to connect to address within
+// timeout, in a connectTimeoutError.
+func (o *output) connectTimeout(address string, timeout time.Duration, err error) error {
+	message := fmt.Sprintf("timed out connecting to %s after %s", address, timeout)
+	if phase := o.currentPhase(); phase != "" {
+		message += " during " + phase
+	}
+
+	return &connectTimeoutError{message: message, err: err}
+}
+
+// connectDialer dials HTTP(S) connections within timeout and names the
+// address that did not answer in time.
+func connectDialer(timeout time.Duration, stderr *output) func(context.Context, string, string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil && ctx.Err() == nil && isTimeout(err) {
+			return nil, stderr.connectTimeout(address, timeout, err)
+		}
+		return conn, err
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// resolveLowSpeed fills in the low-speed limit from
+// GIT_HTTP_LOW_SPEED_LIMIT and GIT_HTTP_LOW_SPEED_TIME, or from
+// http.lowSpeedLimit and http.lowSpeedTime for the repository URL, when
+// opts sets neither. git only applies them to HTTP; here they hold for
+// every transport.
+func resolveLowSpeed(opts *Options) error {
+	if opts.LowSpeedLimit != 0 || opts.LowSpeedTime != 0 {
+		return nil
+	}
+
+	cfg := opts.Config.ForURL(opts.fetchURL())
+	limit, err := lowSpeedSetting(cfg, "GIT_HTTP_LOW_SPEED_LIMIT", "lowSpeedLimit")
+	if err != nil {
+		return err
+	}
+	seconds, err := lowSpeedSetting(cfg, "GIT_HTTP_LOW_SPEED_TIME", "lowSpeedTime")
+	if err != nil {
+		return err
+	}
+
+	opts.LowSpeedLimit, opts.LowSpeedTime = limit, time.Duration(seconds)*time.Second
+	return nil
+}
+
+func lowSpeedSetting(cfg *Config, variable, key string) (int, error) {
+	value := os.Getenv(variable)
+	if value == "" {
+		return cfg.getInt("http", "", key, 0)
+	}
+
+	parsed, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, &Error{
+			Code:    ExitFatal,
+			Message: fmt.Sprintf("bad numeric value '%s' for '%s'", value, variable),
+		}
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,337 @@
+package gitclone
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// traceTimeFormat is the timestamp git puts in front of every trace line.
+const traceTimeFormat = "15:04:05.000000"
+
+// tracer writes the output of one GIT_TRACE* variable. A nil tracer is
+// disabled.
+type tracer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// traceOutputs are the tracers of a run, set up from the environment when
+// it starts: GIT_TRACE for what git-clone does
+// and how long each phase takes, GIT_TRACE_PACKET for the pkt-lines
+// exchanged with the remote and GIT_CURL_VERBOSE or GIT_TRACE_CURL for HTTP
+// requests and responses.
+type traceOutputs struct {
+	general *tracer
+	packet  *tracer
+	curl    *tracer
+}
+
+func openTraces(stderr io.Writer) traceOutputs {
+	outputs := traceOutputs{
+		general: newTracer("GIT_TRACE", stderr),
+		packet:  newTracer("GIT_TRACE_PACKET", stderr),
+		curl:    newTracer("GIT_TRACE_CURL", stderr),
+	}
+	if outputs.curl == nil {
+		if verbose, _ := parseConfigBool(os.Getenv("GIT_CURL_VERBOSE")); verbose {
+			outputs.curl = &tracer{w: stderr}
+		}
+	}
+
+	return outputs
+}
+
+func (t traceOutputs) Close() {
+	for _, output := range []*tracer{t.general, t.packet, t.curl} {
+		if output != nil && output.closer != nil {
+			_ = output.closer.Close()
+		}
+	}
+}
+
+// newTracer interprets a trace variable like git: 1, 2 or true trace to
+// stderr, an absolute path appends to that file, 3 to 9 write to that file
+// descriptor, and an empty value, 0 or false disables tracing.
+func newTracer(name string, stderr io.Writer) *tracer {
+	value := os.Getenv(name)
+	switch {
+	case value == "":
+		return nil
+	case value == "2":
+		return &tracer{w: stderr}
+	case len(value) == 1 && value[0] >= '3' && value[0] <= '9':
+		fd, _ := strconv.Atoi(value)
+		return &tracer{w: os.NewFile(uintptr(fd), name)}
+	case filepath.IsAbs(value):
+		file, err := os.OpenFile(value, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666)
+		if err != nil {
+			fmt.Fprintf(stderr, "warning: could not open '%s' for tracing: %s\n", value, err)
+			return nil
+		}
+		return &tracer{w: file, closer: file}
+	}
+
+	if enabled, ok := parseConfigBool(value); ok {
+		if enabled {
+			return &tracer{w: stderr}
+		}
+		return nil
+	}
+	fmt.Fprintf(stderr, "warning: unknown trace value for '%s': %s\n", name, value)
+	fmt.Fprintln(stderr, "         If you want to trace into a file, then please set "+name)
+	fmt.Fprintln(stderr, "         to an absolute pathname (starting with /)")
+	return nil
+}
+
+func (t *tracer) printf(format string, args ...any) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "%s %s\n", time.Now().Format(traceTimeFormat), fmt.Sprintf(format, args...))
+}
+
+// phase traces how long a phase of the run took once the returned function
+// is called, like GIT_TRACE_PERFORMANCE does for git commands.
+func (t *tracer) phase(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	started := time.Now()
+	return func() {
+		t.performance(name, time.Since(started))
+	}
+}
+
+func (t *tracer) performance(name string, elapsed time.Duration) {
+	t.printf("performance: %.9f s: %s", elapsed.Seconds(), name)
+}
+
+// trace lists where the configuration came from and how long loading it
+// took.
+func (c *Config) trace(t *tracer) {
+	if c == nil || t == nil {
+		return
+	}
+
+	for _, file := range c.files {
+		t.printf("trace: config: read %s", file)
+	}
+	if c.environment > 0 {
+		t.printf("trace: config: %d entries from GIT_CONFIG_COUNT", c.environment)
+	}
+	if c.commandLine > 0 {
+		t.printf("trace: config: %d entries from -c", c.commandLine)
+	}
+	t.performance("load config", c.loadTime)
+}
+
+// tracePacketLines traces the pkt-lines in data the way GIT_TRACE_PACKET
+// shows them, with direction '<' for received and '>' for sent.
+func (t *tracer) tracePacketLines(data []byte, direction byte) {
+	if t == nil {
+		return
+	}
+
+	for len(data) >= 4 {
+		length, err := strconv.ParseUint(string(data[:4]), 16, 16)
+		if err != nil {
+			return
+		}
+		if length < 4 {
+			t.printf("packet: %12s%c %04x", "clone", direction, length)
+			data = data[4:]
+			continue
+		}
+		if int(length) > len(data) {
+			return
+		}
+		t.printf("packet: %12s%c %s", "clone", direction, quotePacket(data[4:length]))
+		data = data[length:]
+	}
+}
+
+// quotePacket prints a pkt-line payload like git: printable characters as
+// they are, others in octal, without the trailing newline.
+func quotePacket(payload []byte) string {
+	payload = bytes.TrimSuffix(payload, []byte("\n"))
+
+	var out strings.Builder
+	for _, c := range payload {
+		if c >= 0x20 && c < 0x7f || c == '\t' {
+			out.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&out, "\\%o", c)
+	}
+
+	return out.String()
+}
+
+// tracingTransport traces the upload-pack conversation of any transport.
+// go-git does not expose the raw stream, so the pkt-lines are re-encoded
+// from the request it sends and the advertisement and acknowledgements it
+// has parsed.
+type tracingTransport struct {
+	next   transport.Transport
+	packet *tracer
+	stats  *cloneStats
+}
+
+func (t *tracingTransport) NewUploadPackSession(endpoint *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	session, err := t.next.NewUploadPackSession(endpoint, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tracingSession{UploadPackSession: session, packet: t.packet, stats: t.stats}, nil
+}
+
+func (t *tracingTransport) NewReceivePackSession(endpoint *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	return t.next.NewReceivePackSession(endpoint, auth)
+}
+
+type tracingSession struct {
+	transport.UploadPackSession
+	packet     *tracer
+	stats      *cloneStats
+	advertised bool
+}
+
+func (s *tracingSession) AdvertisedReferences() (*packp.AdvRefs, error) {
+	return s.AdvertisedReferencesContext(context.Background())
+}
+
+func (s *tracingSession) AdvertisedReferencesContext(ctx context.Context) (*packp.AdvRefs, error) {
+	refs, err := s.UploadPackSession.AdvertisedReferencesContext(ctx)
+	if err == nil && !s.advertised {
+		s.advertised = true
+		s.stats.addAdvertisement(refs)
+		var buf bytes.Buffer
+		if refs.Encode(&buf) == nil {
+			s.packet.tracePacketLines(buf.Bytes(), '<')
+		}
+	}
+
+	return refs, err
+}
+
+func (s *tracingSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	var buf bytes.Buffer
+	if req.UploadRequest.Encode(&buf) == nil && req.UploadHaves.Encode(&buf, true) == nil {
+		buf.WriteString("0009done\n")
+		s.packet.tracePacketLines(buf.Bytes(), '>')
+	}
+
+	response, err := s.UploadPackSession.UploadPack(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf.Reset()
+	if !req.Depth.IsZero() && response.ShallowUpdate.Encode(&buf) == nil {
+		s.packet.tracePacketLines(buf.Bytes(), '<')
+	}
+	buf.Reset()
+	if response.ServerResponse.Encode(&buf, false) == nil {
+		s.packet.tracePacketLines(buf.Bytes(), '<')
+	}
+
+	return response, nil
+}
+
+// traceTransports wraps every transport of a run for GIT_TRACE_PACKET and
+// for the advertised refs Stats counts.
+func traceTransports(protocols map[string]transport.Transport, stderr *output) map[string]transport.Transport {
+	if stderr.traces.packet == nil && stderr.stats == nil {
+		return protocols
+	}
+
+	traced := make(map[string]transport.Transport, len(protocols))
+	for name, t := range protocols {
+		traced[name] = &tracingTransport{next: t, packet: stderr.traces.packet, stats: stderr.stats}
+	}
+
+	return traced
+}
+
+// curlRoundTripper traces HTTP requests and responses like
+// GIT_CURL_VERBOSE, with credentials redacted.
+type curlRoundTripper struct {
+	next  http.RoundTripper
+	trace *tracer
+}
+
+func (rt *curlRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	rt.trace.printf("=> Send header: %s %s %s", req.Method, req.URL.RequestURI(), req.Proto)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	rt.trace.printf("=> Send header: Host: %s", host)
+	// net/http sends req.Host and ignores a Host header, so it is not
+	// traced a second time.
+	header := req.Header.Clone()
+	header.Del("Host")
+	rt.traceHeaders("=> Send header", header)
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		rt.trace.printf("== Info: %s %s failed after %s: %s", req.Method, ScrubURL(req.URL.String()), time.Since(started).Round(time.Millisecond), err)
+		return nil, err
+	}
+
+	rt.trace.printf("<= Recv header: %s %s", resp.Proto, resp.Status)
+	rt.traceHeaders("<= Recv header", resp.Header)
+	rt.trace.printf("== Info: %s %s answered in %s", req.Method, ScrubURL(req.URL.String()), time.Since(started).Round(time.Millisecond))
+
+	return resp, nil
+}
+
+func (rt *curlRoundTripper) traceHeaders(prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range header[name] {
+			rt.trace.printf("%s: %s: %s", prefix, name, redactHeader(name, value))
+		}
+	}
+}
+
+// redactHeader hides credentials like git does, keeping the authentication
+// scheme.
+func redactHeader(name, value string) string {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Proxy-Authorization":
+		if scheme, _, ok := strings.Cut(value, " "); ok {
+			return scheme + " <redacted>"
+		}
+		return "<redacted>"
+	case "Cookie", "Set-Cookie":
+		return "<redacted>"
+	}
+
+	return value
+}
@@ -0,0 +1,816 @@
+package gitclone
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/file"
+	gitproto "github.com/go-git/go-git/v5/plumbing/transport/git"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sessionTransports builds the HTTP(S) and SSH clients that apply the
+// effective configuration, and returns auth wrapped so that every session
+// go-git opens with it goes through them: ls-remote, the fetch and
+// submodule fetches all see the same -c settings. release must be called
+// once the run is done with the network.
+func sessionTransports(opts Options, auth transport.AuthMethod, stderr *output) (transport.AuthMethod, func(), error) {
+	if err := checkProtocolVersion(opts, stderr); err != nil {
+		return nil, nil, err
+	}
+
+	proxies := newProxyResolver(opts)
+
+	httpClient, err := newHTTPTransport(opts, proxies, stderr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	command, err := resolveSSHCommand(opts.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// -o ConnectTimeout in the ssh command counts unless it is overridden.
+	sshConnectTimeout := opts.ConnectTimeout
+	if sshConnectTimeout == 0 {
+		sshConnectTimeout = command.connectTimeout
+	}
+
+	release := acquireDispatchers()
+	return &sessionAuth{
+		inner: auth,
+		protocols: traceTransports(countTransports(map[string]transport.Transport{
+			"http":  httpClient,
+			"https": httpClient,
+			"ssh": &sshTransport{
+				next:           gitssh.DefaultClient,
+				proxies:        proxies,
+				command:        command,
+				connectTimeout: sshConnectTimeout,
+				stderr:         stderr,
+			},
+			"file": file.DefaultClient,
+			"git":  gitproto.DefaultClient,
+		}, stderr), stderr),
+	}, release, nil
+}
+
+// sessionAuth carries the transports of a run along with its credentials.
+// go-git v5 takes no transport in its clone, fetch or list options and
+// looks one up in client.Protocols, a table shared by the whole process.
+// While runs are active that table holds dispatchTransports, which pick the
+// run's transport from the auth method they are given, so concurrent runs
+// never see each other's settings. Sessions gitclone opens itself skip the
+// table, see sessionTransport.
+type sessionAuth struct {
+	inner     transport.AuthMethod
+	protocols map[string]transport.Transport
+}
+
+func (a *sessionAuth) Name() string {
+	if a.inner == nil {
+		return "none"
+	}
+	return a.inner.Name()
+}
+
+func (a *sessionAuth) String() string {
+	if a.inner == nil {
+		return "none"
+	}
+	return a.inner.String()
+}
+
+// dispatchers tracks the dispatchTransports in client.Protocols: they are
+// installed when the first run starts and the transports they replaced are
+// put back when the last run ends, so that the table is the host program's
+// again whenever no run is active.
+var dispatchers struct {
+	mu        sync.Mutex
+	active    int
+	installed map[string]*dispatchTransport
+}
+
+// dispatchedProtocols are the schemes sessionAuth carries transports for.
+var dispatchedProtocols = []string{"http", "https", "ssh", "file", "git"}
+
+// acquireDispatchers makes sure the dispatchTransports are installed for a
+// run and returns the function that ends the run's claim on them. A
+// transport the host installs while runs are active stays in place and is
+// not restored over.
+func acquireDispatchers() func() {
+	dispatchers.mu.Lock()
+	defer dispatchers.mu.Unlock()
+
+	if dispatchers.active == 0 {
+		dispatchers.installed = make(map[string]*dispatchTransport, len(dispatchedProtocols))
+		for _, name := range dispatchedProtocols {
+			dispatcher := &dispatchTransport{protocol: name, fallback: client.Protocols[name]}
+			dispatchers.installed[name] = dispatcher
+			client.InstallProtocol(name, dispatcher)
+		}
+	}
+	dispatchers.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(releaseDispatchers)
+	}
+}
+
+func releaseDispatchers() {
+	dispatchers.mu.Lock()
+	defer dispatchers.mu.Unlock()
+
+	dispatchers.active--
+	if dispatchers.active > 0 {
+		return
+	}
+	for name, dispatcher := range dispatchers.installed {
+		if current, ok := client.Protocols[name].(*dispatchTransport); ok && current == dispatcher {
+			client.InstallProtocol(name, dispatcher.fallback)
+		}
+	}
+	dispatchers.installed = nil
+}
+
+// sessionTransport picks the transport for a session gitclone opens itself
+// from the run's sessionAuth, without going through client.Protocols.
+func sessionTransport(endpoint *transport.Endpoint, auth transport.AuthMethod) (transport.Transport, transport.AuthMethod, error) {
+	if session, ok := auth.(*sessionAuth); ok {
+		if next, ok := session.protocols[endpoint.Protocol]; ok {
+			return next, session.inner, nil
+		}
+		auth = session.inner
+	}
+
+	next, err := client.NewClient(endpoint)
+	return next, auth, err
+}
+
+type dispatchTransport struct {
+	protocol string
+	fallback transport.Transport
+}
+
+func (t *dispatchTransport) NewUploadPackSession(endpoint *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	next, auth, err := t.resolve(auth)
+	if err != nil {
+		return nil, err
+	}
+	return next.NewUploadPackSession(endpoint, auth)
+}
+
+func (t *dispatchTransport) NewReceivePackSession(endpoint *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	next, auth, err := t.resolve(auth)
+	if err != nil {
+		return nil, err
+	}
+	return next.NewReceivePackSession(endpoint, auth)
+}
+
+func (t *dispatchTransport) resolve(auth transport.AuthMethod) (transport.Transport, transport.AuthMethod, error) {
+	if session, ok := auth.(*sessionAuth); ok {
+		if next, ok := session.protocols[t.protocol]; ok {
+			return next, session.inner, nil
+		}
+		auth = session.inner
+	}
+	if t.fallback == nil {
+		return nil, nil, fmt.Errorf("unsupported scheme %q", t.protocol)
+	}
+
+	return t.fallback, auth, nil
+}
+
+// checkProtocolVersion accepts the values git accepts. go-git speaks the
+// v0/v1 protocol only, so version 2 falls back the way git does against
+// servers that do not advertise it, with a warning that it did.
+func checkProtocolVersion(opts Options, stderr io.Writer) error {
+	value, ok := opts.Config.Get("protocol", "", "version")
+	if !ok {
+		return nil
+	}
+
+	switch strings.TrimSpace(value) {
+	case "0", "1":
+		return nil
+	case "2":
+		if !opts.Quiet {
+			fmt.Fprintln(stderr, "warning: protocol.version=2 is not supported; using protocol version 0")
+		}
+		return nil
+	}
+
+	return &Error{
+		Code:    ExitFatal,
+		Message: fmt.Sprintf("unknown value for config 'protocol.version': %s", value),
+	}
+}
+
+func newHTTPTransport(opts Options, proxies *proxyResolver, stderr *output) (transport.Transport, error) {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.Proxy = proxies.httpProxy
+	if opts.ConnectTimeout > 0 {
+		base.DialContext = connectDialer(opts.ConnectTimeout, stderr)
+		base.TLSHandshakeTimeout = opts.ConnectTimeout
+	}
+
+	roundTripper := &scopedRoundTripper{
+		config:     opts.Config,
+		base:       base,
+		trace:      stderr.traces.curl,
+		transports: make(map[tlsSettings]*http.Transport),
+	}
+	// The settings for the repository itself are checked before anything
+	// is fetched, so that a bad value fails the run right away.
+	settings, err := roundTripper.settings(opts.fetchURL())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := roundTripper.transport(settings.tls); err != nil {
+		return nil, err
+	}
+
+	return githttp.NewClient(&http.Client{Transport: roundTripper}), nil
+}
+
+// httpSettings are the http.* settings that apply to the URL of a request.
+type httpSettings struct {
+	tls       tlsSettings
+	headers   http.Header
+	userAgent string
+}
+
+type tlsSettings struct {
+	verify bool
+	caInfo string
+}
+
+// scopedRoundTripper applies http.* settings per request, with the
+// http.<url>.* entries that match the request URL taking precedence, so
+// that submodules on other hosts get their own. Requests with the same TLS
+// settings share a transport and with it their connections.
+type scopedRoundTripper struct {
+	config *Config
+	base   *http.Transport
+	trace  *tracer
+
+	mu         sync.Mutex
+	transports map[tlsSettings]*http.Transport
+}
+
+func (rt *scopedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	settings, err := rt.settings(req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+	base, err := rt.transport(settings.tls)
+	if err != nil {
+		return nil, err
+	}
+
+	var next http.RoundTripper = base
+	if rt.trace != nil {
+		next = &curlRoundTripper{next: next, trace: rt.trace}
+	}
+	if len(settings.headers) > 0 || settings.userAgent != "" {
+		next = &headerRoundTripper{
+			next:      next,
+			headers:   settings.headers,
+			userAgent: settings.userAgent,
+		}
+	}
+
+	return next.RoundTrip(req)
+}
+
+func (rt *scopedRoundTripper) settings(rawURL string) (httpSettings, error) {
+	cfg := rt.config.ForURL(rawURL)
+
+	tls, err := httpTLSSettings(cfg)
+	if err != nil {
+		return httpSettings{}, err
+	}
+
+	headers, err := httpExtraHeaders(cfg)
+	if err != nil {
+		return httpSettings{}, err
+	}
+
+	userAgent := os.Getenv("GIT_HTTP_USER_AGENT")
+	if userAgent == "" {
+		userAgent, _ = cfg.Get("http", "", "userAgent")
+	}
+
+	return httpSettings{tls: tls, headers: headers, userAgent: userAgent}, nil
+}
+
+func (rt *scopedRoundTripper) transport(settings tlsSettings) (*http.Transport, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if base, ok := rt.transports[settings]; ok {
+		return base, nil
+	}
+
+	tlsConfig, err := settings.config()
+	if err != nil {
+		return nil, err
+	}
+	base := rt.base
+	if tlsConfig != nil {
+		base = rt.base.Clone()
+		base.TLSClientConfig = tlsConfig
+	}
+	rt.transports[settings] = base
+
+	return base, nil
+}
+
+func httpTLSSettings(cfg *Config) (tlsSettings, error) {
+	sslVerify, err := cfg.GetBool("http", "", "sslVerify", true)
+	if err != nil {
+		return tlsSettings{}, err
+	}
+	if os.Getenv("GIT_SSL_NO_VERIFY") != "" {
+		sslVerify = false
+	}
+
+	caInfo := os.Getenv("GIT_SSL_CAINFO")
+	if caInfo == "" {
+		caInfo, _ = cfg.Get("http", "", "sslCAInfo")
+	}
+
+	return tlsSettings{verify: sslVerify, caInfo: caInfo}, nil
+}
+
+func (s tlsSettings) config() (*tls.Config, error) {
+	if s.verify && s.caInfo == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: !s.verify}
+	if s.caInfo != "" {
+		bundle, err := os.ReadFile(expandHome(s.caInfo))
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, &Error{
+				Code:    ExitFatal,
+				Message: fmt.Sprintf("no certificates found in '%s'", s.caInfo),
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// httpExtraHeaders collects http.extraHeader values. Like git, an empty value
+// resets the list collected so far.
+func httpExtraHeaders(cfg *Config) (http.Header, error) {
+	headers := http.Header{}
+	for _, value := range cfg.GetAll("http", "", "extraHeader") {
+		if value == "" {
+			headers = http.Header{}
+			continue
+		}
+
+		name, headerValue, ok := strings.Cut(value, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, &Error{
+				Code:    ExitFatal,
+				Message: fmt.Sprintf("invalid http.extraHeader '%s'", value),
+			}
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(headerValue))
+	}
+
+	return headers, nil
+}
+
+type headerRoundTripper struct {
+	next      http.RoundTripper
+	headers   http.Header
+	userAgent string
+}
+
+func (rt *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range rt.headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if rt.userAgent != "" {
+		req.Header.Set("User-Agent", rt.userAgent)
+	}
+
+	return rt.next.RoundTrip(req)
+}
+
+// sshCommand is the subset of an ssh command line (core.sshCommand or
+// GIT_SSH_COMMAND) that can be mapped onto the built-in SSH client.
+type sshCommand struct {
+	raw                   string
+	identity              string
+	user                  string
+	port                  int
+	strictHostKeyChecking string
+	knownHostsFiles       []string
+	connectTimeout        time.Duration
+}
+
+func resolveSSHCommand(cfg *Config) (sshCommand, error) {
+	raw := os.Getenv("GIT_SSH_COMMAND")
+	if raw == "" {
+		raw, _ = cfg.Get("core", "", "sshCommand")
+	}
+	if strings.TrimSpace(raw) == "" {
+		return sshCommand{}, nil
+	}
+
+	return parseSSHCommand(raw)
+}
+
+// sshShortOptions maps the ssh short options git users commonly put in
+// core.sshCommand onto their -o equivalents.
+var sshShortOptions = map[byte]string{
+	'i': "IdentityFile",
+	'l': "User",
+	'p': "Port",
+}
+
+func parseSSHCommand(raw string) (sshCommand, error) {
+	unsupported := func(reason string) error {
+		return &Error{
+			Code:    ExitFatal,
+			Message: fmt.Sprintf("ssh command '%s' is not supported: %s", raw, reason),
+		}
+	}
+
+	args, err := splitCommandLine(raw)
+	if err != nil {
+		return sshCommand{}, unsupported(err.Error())
+	}
+
+	program := strings.TrimSuffix(filepath.Base(args[0]), ".exe")
+	if program != "ssh" {
+		return sshCommand{}, unsupported("only ssh is available in this build")
+	}
+
+	command := sshCommand{raw: raw}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' {
+			return sshCommand{}, unsupported(fmt.Sprintf("unexpected argument '%s'", arg))
+		}
+
+		flag := arg[1]
+		if strings.IndexByte("46AaTqvx", flag) >= 0 {
+			continue
+		}
+
+		option, isShort := sshShortOptions[flag]
+		if flag != 'o' && !isShort {
+			return sshCommand{}, unsupported(fmt.Sprintf("option '-%c'", flag))
+		}
+
+		value := arg[2:]
+		if value == "" {
+			if i+1 >= len(args) {
+				return sshCommand{}, unsupported(fmt.Sprintf("option '-%c' requires a value", flag))
+			}
+			i++
+			value = args[i]
+		}
+
+		if flag == 'o' {
+			key, optionValue, ok := strings.Cut(value, "=")
+			if !ok {
+				key, optionValue, ok = strings.Cut(value, " ")
+			}
+			if !ok {
+				return sshCommand{}, unsupported(fmt.Sprintf("malformed option '-o %s'", value))
+			}
+			option, value = key, strings.TrimSpace(optionValue)
+		}
+
+		if err := command.setOption(option, value); err != nil {
+			return sshCommand{}, unsupported(err.Error())
+		}
+	}
+
+	return command, nil
+}
+
+func (c *sshCommand) setOption(key, value string) error {
+	switch strings.ToLower(key) {
+	case "identityfile":
+		if c.identity == "" {
+			c.identity = expandHome(value)
+		}
+	case "user":
+		c.user = value
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port '%s'", value)
+		}
+		c.port = port
+	case "stricthostkeychecking":
+		switch strings.ToLower(value) {
+		case "yes", "no", "off", "accept-new", "ask":
+			c.strictHostKeyChecking = strings.ToLower(value)
+		default:
+			return fmt.Errorf("invalid StrictHostKeyChecking '%s'", value)
+		}
+	case "userknownhostsfile":
+		for _, file := range strings.Fields(value) {
+			c.knownHostsFiles = append(c.knownHostsFiles, expandHome(file))
+		}
+	case "connecttimeout":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid ConnectTimeout '%s'", value)
+		}
+		c.connectTimeout = time.Duration(seconds) * time.Second
+	case "batchmode", "identitiesonly", "loglevel", "serveraliveinterval", "serveralivecountmax":
+	default:
+		return fmt.Errorf("option '-o %s'", key)
+	}
+
+	return nil
+}
+
+func (c sshCommand) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	switch c.strictHostKeyChecking {
+	case "no", "off":
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	if len(c.knownHostsFiles) == 0 && c.strictHostKeyChecking != "accept-new" {
+		return nil, nil
+	}
+
+	files := c.knownHostsFiles
+	if len(files) == 0 {
+		files = defaultKnownHostsFiles()
+	}
+	existing := files[:0:0]
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+
+	var known ssh.HostKeyCallback
+	if len(existing) > 0 {
+		var err error
+		if known, err = knownhosts.New(existing...); err != nil {
+			return nil, err
+		}
+	}
+
+	acceptNew := c.strictHostKeyChecking == "accept-new"
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if known == nil {
+			if acceptNew {
+				return nil
+			}
+			return fmt.Errorf("no known_hosts file found in %s", strings.Join(files, ", "))
+		}
+
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if acceptNew && errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil
+		}
+		return err
+	}, nil
+}
+
+func defaultKnownHostsFiles() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+
+	return []string{filepath.Join(home, ".ssh", "known_hosts")}
+}
+
+// sshTransport applies the ssh command settings, SOCKS proxy and connect
+// timeout to every SSH session before handing it to go-git's SSH client,
+// which connects as it opens the session.
+type sshTransport struct {
+	next           transport.Transport
+	proxies        *proxyResolver
+	command        sshCommand
+	connectTimeout time.Duration
+	stderr         *output
+}
+
+func (t *sshTransport) NewUploadPackSession(
+	endpoint *transport.Endpoint,
+	auth transport.AuthMethod,
+) (transport.UploadPackSession, error) {
+	endpoint, auth, err := t.prepare(endpoint, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := t.next.NewUploadPackSession(endpoint, auth)
+	return session, t.connectError(endpoint, err)
+}
+
+func (t *sshTransport) NewReceivePackSession(
+	endpoint *transport.Endpoint,
+	auth transport.AuthMethod,
+) (transport.ReceivePackSession, error) {
+	endpoint, auth, err := t.prepare(endpoint, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := t.next.NewReceivePackSession(endpoint, auth)
+	return session, t.connectError(endpoint, err)
+}
+
+// connectError names the address of a connection that did not answer
+// within the connect timeout.
+func (t *sshTransport) connectError(endpoint *transport.Endpoint, err error) error {
+	if err == nil || t.connectTimeout <= 0 || !isTimeout(err) {
+		return err
+	}
+
+	port := endpoint.Port
+	if port == 0 {
+		port = gitssh.DefaultPort
+	}
+	address := net.JoinHostPort(endpoint.Host, strconv.Itoa(port))
+	return t.stderr.connectTimeout(address, t.connectTimeout, err)
+}
+
+func (t *sshTransport) prepare(
+	endpoint *transport.Endpoint,
+	auth transport.AuthMethod,
+) (*transport.Endpoint, transport.AuthMethod, error) {
+	prepared := *endpoint
+	if prepared.User == "" && t.command.user != "" {
+		prepared.User = t.command.user
+	}
+	if prepared.Port == 0 && t.command.port != 0 {
+		prepared.Port = t.command.port
+	}
+
+	if prepared.Proxy.URL == "" {
+		proxy, err := t.proxies.proxyFor(&prepared)
+		if err != nil {
+			return nil, nil, err
+		}
+		prepared.Proxy = proxy
+	}
+
+	hostKeyCallback, err := t.command.hostKeyCallback()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if auth == nil && (t.command.identity != "" || hostKeyCallback != nil || t.connectTimeout > 0) {
+		userName, err := sshUserForEndpoint(&prepared)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if t.command.identity != "" {
+			auth, err = gitssh.NewPublicKeysFromFile(userName, t.command.identity, "")
+		} else {
+			auth, err = gitssh.NewSSHAgentAuth(userName)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if hostKeyCallback != nil {
+		switch typed := auth.(type) {
+		case *gitssh.PublicKeys:
+			typed.HostKeyCallback = hostKeyCallback
+		case *gitssh.PublicKeysCallback:
+			typed.HostKeyCallback = hostKeyCallback
+		}
+	}
+
+	if sshAuth, ok := auth.(gitssh.AuthMethod); ok && t.connectTimeout > 0 {
+		auth = &connectTimeoutAuth{AuthMethod: sshAuth, timeout: t.connectTimeout}
+	}
+
+	return &prepared, auth, nil
+}
+
+// connectTimeoutAuth sets the time go-git's SSH client gives the connection
+// to be established, which it only takes from the auth method.
+type connectTimeoutAuth struct {
+	gitssh.AuthMethod
+	timeout time.Duration
+}
+
+func (a *connectTimeoutAuth) ClientConfig() (*ssh.ClientConfig, error) {
+	config, err := a.AuthMethod.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.Timeout = a.timeout
+
+	return config, nil
+}
+
+// splitCommandLine splits a command line the way a POSIX shell would for
+// plain words, single and double quotes and backslash escapes.
+func splitCommandLine(line string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	return args, nil
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptSignals are the signals that stop a clone and make it remove
+// what it created before git-clone exits.
+var interruptSignals = map[os.Signal]string{
+	os.Interrupt:    "SIGINT",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+// notifyInterrupt returns a context that is canceled when SIGINT or SIGTERM
+// arrives, with a cause that exits like git does after the signal: 128 plus
+// the signal number. Only the first signal is caught, so a second one ends
+// git-clone at once if cleaning up takes too long. stop releases the
+// signals.
+func notifyInterrupt(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			signal.Stop(signals)
+			cancel(interruptError(sig))
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		signal.Stop(signals)
+		cancel(nil)
+	}
+}
+
+func interruptError(sig os.Signal) error {
+	code := exitFatal
+	if number, ok := sig.(syscall.Signal); ok {
+		code += int(number)
+	}
+
+	return &cliError{
+		code:    code,
+		prefix:  "fatal",
+		message: fmt.Sprintf("interrupted by %s", interruptSignals[sig]),
+	}
+}
+
+// interruptCause replaces the error of a run cut short by a signal with the
+// signal's.
+func interruptCause(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	if cause, ok := context.Cause(ctx).(*cliError); ok {
+		return cause
+	}
+
+	return err
+}
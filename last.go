@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/n0madic/git-clone/gitclone"
+)
+
+// gitDateFormat is git's default date format, as used by %ad and the
+// medium and full presets.
+const gitDateFormat = "Mon Jan 2 15:04:05 2006 -0700"
+
+// isoStrictDateFormat is git's --date=iso-strict, which unlike RFC 3339 in
+// Go never abbreviates UTC to Z.
+const isoStrictDateFormat = "2006-01-02T15:04:05-07:00"
+
+// lastFormat is a parsed --last-format value: either a named preset or a
+// template of git pretty placeholders.
+type lastFormat struct {
+	preset   string
+	template string
+	// terminate appends a newline after a template, which is the
+	// difference between git's tformat: and format:.
+	terminate bool
+}
+
+// parseLastFormat accepts the presets, format:<template>,
+// tformat:<template> and, like git --pretty, any string with a % in it as a
+// tformat template.
+func parseLastFormat(value string) (lastFormat, error) {
+	switch value {
+	case "oneline", "short", "medium", "full", "json":
+		return lastFormat{preset: value}, nil
+	}
+	if template, ok := strings.CutPrefix(value, "format:"); ok {
+		return lastFormat{template: template}, nil
+	}
+	if template, ok := strings.CutPrefix(value, "tformat:"); ok {
+		return lastFormat{template: template, terminate: true}, nil
+	}
+	if strings.Contains(value, "%") {
+		return lastFormat{template: value, terminate: true}, nil
+	}
+
+	return lastFormat{}, &cliError{
+		code:      exitUsage,
+		prefix:    "error",
+		message:   fmt.Sprintf("invalid value for --last-format: '%s' (expected oneline, short, medium, full, json or a format string)", value),
+		showUsage: true,
+	}
+}
+
+// printLastCommit prints the commit HEAD points to. Without --last-format it
+// keeps the output --last always had.
+func printLastCommit(result *gitclone.Result, format lastFormat, stdout io.Writer) error {
+	repo := result.Repository
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+
+	var output string
+	switch format.preset {
+	case "":
+		if format.template == "" {
+			output = commit.String()
+			break
+		}
+		output = expandPretty(format.template, commit)
+		if format.terminate {
+			output += "\n"
+		}
+	case "oneline":
+		output = fmt.Sprintf("%s %s\n", commit.Hash, prettySubject(commit))
+	case "short":
+		title, _ := splitMessage(commit.Message)
+		output = fmt.Sprintf("commit %s\nAuthor: %s\n\n%s", commit.Hash, commit.Author.String(), indentMessage(strings.Join(title, "\n")))
+	case "medium":
+		output = fmt.Sprintf("commit %s\nAuthor: %s\nDate:   %s\n\n%s",
+			commit.Hash, commit.Author.String(), commit.Author.When.Format(gitDateFormat), indentMessage(commit.Message))
+	case "full":
+		output = fmt.Sprintf("commit %s\nAuthor: %s\nCommit: %s\n\n%s",
+			commit.Hash, commit.Author.String(), commit.Committer.String(), indentMessage(commit.Message))
+	case "json":
+		return json.NewEncoder(stdout).Encode(newLastCommitJSON(result.Ref, commit))
+	}
+
+	_, err = io.WriteString(stdout, output)
+	return err
+}
+
+// lastCommitJSON is what --last-format=json prints. Ref is the one
+// --output=json reports, so a tag checkout names the tag rather than HEAD.
+type lastCommitJSON struct {
+	Hash      string        `json:"hash"`
+	Ref       string        `json:"ref"`
+	Author    signatureJSON `json:"author"`
+	Committer signatureJSON `json:"committer"`
+	Subject   string        `json:"subject"`
+	Body      string        `json:"body"`
+	Parents   []string      `json:"parents"`
+}
+
+type signatureJSON struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Date  string `json:"date"`
+}
+
+func newLastCommitJSON(ref string, commit *object.Commit) lastCommitJSON {
+	parents := make([]string, 0, len(commit.ParentHashes))
+	for _, parent := range commit.ParentHashes {
+		parents = append(parents, parent.String())
+	}
+	_, body := splitMessage(commit.Message)
+
+	return lastCommitJSON{
+		Hash:      commit.Hash.String(),
+		Ref:       ref,
+		Author:    newSignatureJSON(commit.Author),
+		Committer: newSignatureJSON(commit.Committer),
+		Subject:   prettySubject(commit),
+		Body:      body,
+		Parents:   parents,
+	}
+}
+
+func newSignatureJSON(signature object.Signature) signatureJSON {
+	return signatureJSON{
+		Name:  signature.Name,
+		Email: signature.Email,
+		Date:  signature.When.Format(isoStrictDateFormat),
+	}
+}
+
+// expandPretty expands git pretty placeholders in template. Placeholders it
+// does not know are copied through unchanged, as git does.
+func expandPretty(template string, commit *object.Commit) string {
+	var out strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' || i+1 == len(template) {
+			out.WriteByte(template[i])
+			continue
+		}
+
+		if i+2 < len(template) {
+			if value, ok := prettySignaturePlaceholder(template[i+1:i+3], commit); ok {
+				out.WriteString(value)
+				i += 2
+				continue
+			}
+		}
+		if value, ok := prettyPlaceholder(template[i+1], commit); ok {
+			out.WriteString(value)
+			i++
+			continue
+		}
+		out.WriteByte('%')
+	}
+
+	return out.String()
+}
+
+func prettyPlaceholder(code byte, commit *object.Commit) (string, bool) {
+	switch code {
+	case 'H':
+		return commit.Hash.String(), true
+	case 'h':
+		return commit.Hash.String()[:7], true
+	case 'T':
+		return commit.TreeHash.String(), true
+	case 't':
+		return commit.TreeHash.String()[:7], true
+	case 'P', 'p':
+		parents := make([]string, 0, len(commit.ParentHashes))
+		for _, parent := range commit.ParentHashes {
+			if code == 'p' {
+				parents = append(parents, parent.String()[:7])
+			} else {
+				parents = append(parents, parent.String())
+			}
+		}
+		return strings.Join(parents, " "), true
+	case 's':
+		return prettySubject(commit), true
+	case 'b':
+		_, body := splitMessage(commit.Message)
+		return body, true
+	case 'B':
+		return commit.Message, true
+	case 'n':
+		return "\n", true
+	case '%':
+		return "%", true
+	}
+
+	return "", false
+}
+
+// prettySignaturePlaceholder expands the two-letter author (%a) and
+// committer (%c) placeholders: name, email and date in git's default, ISO
+// 8601 strict or Unix timestamp form.
+func prettySignaturePlaceholder(code string, commit *object.Commit) (string, bool) {
+	var signature object.Signature
+	switch code[0] {
+	case 'a':
+		signature = commit.Author
+	case 'c':
+		signature = commit.Committer
+	default:
+		return "", false
+	}
+
+	switch code[1] {
+	case 'n':
+		return signature.Name, true
+	case 'e':
+		return signature.Email, true
+	case 'd':
+		return signature.When.Format(gitDateFormat), true
+	case 'I':
+		return signature.When.Format(isoStrictDateFormat), true
+	case 't':
+		return fmt.Sprint(signature.When.Unix()), true
+	}
+
+	return "", false
+}
+
+// splitMessage splits a commit message into its title paragraph and the
+// body that follows it, the way git's %s and %b see them.
+func splitMessage(message string) ([]string, string) {
+	lines := strings.Split(strings.TrimRight(message, "\n"), "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+
+	var title []string
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) != "" {
+		title = append(title, lines[0])
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 {
+		return title, ""
+	}
+
+	return title, strings.Join(lines, "\n") + "\n"
+}
+
+// prettySubject is git's %s: the title paragraph joined into one line.
+func prettySubject(commit *object.Commit) string {
+	title, _ := splitMessage(commit.Message)
+	return strings.Join(title, " ")
+}
+
+// indentMessage indents every line of message by four spaces like git log
+// does.
+func indentMessage(message string) string {
+	var out strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(message, "\n"), "\n") {
+		out.WriteString("    " + line + "\n")
+	}
+
+	return out.String()
+}
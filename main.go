@@ -1,23 +1,26 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/n0madic/git-clone/gitclone"
 	"github.com/spf13/pflag"
 )
 
 const (
-	exitOK    = 0
-	exitFatal = 128
-	exitUsage = 129
+	exitOK      = 0
+	exitUpdated = 1
+	exitFatal   = 128
+	exitUsage   = 129
 
 	noOptSentinel = "__git_clone_noopt__"
 )
@@ -27,6 +30,7 @@ const cloneUsage = `usage: git clone [<options>] [--] <repo> [<dir>]
     -v, --[no-]verbose    be more verbose
     -q, --[no-]quiet      be more quiet
     --[no-]progress       force progress reporting
+    --[no-]reject-shallow don't clone shallow repository
     -n, --no-checkout     don't create a checkout
     --checkout            opposite of --no-checkout
     --[no-]bare           create a bare repository
@@ -53,8 +57,31 @@ Unsupported vanilla git clone options that are not implemented by this build are
 
 Extensions:
     --pull                if destination already exists as a repository, pull instead of failing
+    --pull-mode <mode>    reconcile local commits with ff-only, rebase or merge
+    --[no-]autostash      stash local changes before --pull and reapply them after
+    --reset               make --pull hard-reset the branch to the remote tip
+    --clean               with --reset, also remove untracked files
+    --set-url             let --pull repoint the remote when its URL differs
+    --[no-]prune          let --pull remove remote-tracking refs deleted upstream
+    --[no-]prune-tags     with --prune, also remove local tags deleted upstream
+    --deepen <n>          let --pull extend a shallow history by <n> commits
+    --unshallow           let --pull fetch the complete history of a shallow clone
+    --shallow-since <time>
+                          let --pull extend a shallow history back to <time>
+    --exit-code           with --pull, exit with 1 if anything was cloned or updated
     --last                print the latest checked out commit after clone/pull
+    --last-format <fmt>   print it as oneline, short, medium, full, json or a format
+                          string with git pretty placeholders
+    --output json         print a JSON summary of the run to stdout
+    --progress-format <format>
+                          write progress to stderr as text or as jsonl events
+    --stats               print counts, sizes and phase timings of the run to stderr
     --identity <file>     use the given SSH private key file or PEM contents
+    --timeout <duration>  give up when the whole run takes longer, e.g. 30s or 5m
+    --connect-timeout <duration>
+                          give up when connecting to the remote takes longer
+    --retries <n>         retry ls-remote and fetches up to <n> times after transient
+                          network failures, with exponential backoff
 `
 
 type progressMode int
@@ -175,39 +202,41 @@ type rawOptions struct {
 	noSparse            bool
 	bundleURI           string
 	pull                bool
+	pullMode            string
+	autostash           bool
+	reset               bool
+	clean               bool
+	setURL              bool
+	prune               bool
+	noPrune             bool
+	pruneTags           bool
+	noPruneTags         bool
+	deepen              int
+	unshallow           bool
+	exitCode            bool
+	noAutostash         bool
 	last                bool
+	lastFormat          string
+	output              string
+	progressFormat      string
+	stats               bool
 	identity            string
+	timeout             string
+	connectTimeout      string
+	retries             int
 	occurrences         []flagOccurrence
 }
 
-type configEntry struct {
-	Section    string
-	Subsection string
-	Key        string
-	Value      string
-}
-
+// cloneOptions are the gitclone options a command line asks for and what
+// the command does with the result.
 type cloneOptions struct {
-	Repository        string
-	Directory         string
-	RemoteName        string
-	Branch            string
-	Identity          string
-	Depth             int
-	Tags              git.TagMode
-	Checkout          bool
-	Bare              bool
-	Mirror            bool
-	Shared            bool
-	SingleBranch      bool
-	RecurseSubmodules bool
-	ShallowSubmodules bool
-	Quiet             bool
-	Verbose           bool
-	Progress          progressMode
-	Pull              bool
-	Last              bool
-	ConfigEntries     []configEntry
+	gitclone.Options
+	ProgressMode   progressMode
+	ProgressFormat progressFormat
+	ExitCode       bool
+	Last           bool
+	LastFormat     lastFormat
+	Output         string
 }
 
 func run(args []string, stdout, stderr io.Writer) int {
@@ -216,30 +245,59 @@ func run(args []string, stdout, stderr io.Writer) int {
 		return renderError(err, stdout, stderr)
 	}
 
-	repo, err := executeClone(opts, stderr)
+	started := time.Now()
+	opts.Trace = stderr
+	switch {
+	case opts.ProgressFormat == progressJSONL:
+		events := newEventWriter(stderr, opts.ProgressMode)
+		defer events.Flush()
+		opts.Log = events
+		if events.progress {
+			opts.Progress = events
+		}
+	case showProgress(opts.ProgressMode, stderr):
+		bar := newProgressBar(stderr, isTerminalWriter(stderr))
+		defer bar.Flush()
+		opts.Log, opts.Progress = bar, bar
+	default:
+		opts.Log = stderr
+	}
+	stderr = opts.Log
+
+	ctx, stop := notifyInterrupt(context.Background())
+	defer stop()
+	result, err := gitclone.Clone(ctx, opts.Options)
+	err = interruptCause(ctx, err)
+	if opts.Output == "json" {
+		if outputErr := writeRunResult(stdout, opts, result, started, err); outputErr != nil && err == nil {
+			err = outputErr
+		}
+	}
 	if err != nil {
 		return renderError(err, stdout, stderr)
 	}
 
+	if result.Stats != nil {
+		if err := writeStats(stderr, result.Stats); err != nil {
+			return renderError(err, stdout, stderr)
+		}
+	}
+
 	if opts.Last {
-		if err := printLastCommit(repo, stdout); err != nil {
+		if err := printLastCommit(result, opts.LastFormat, stdout); err != nil {
 			return renderError(err, stdout, stderr)
 		}
 	}
 
+	if opts.ExitCode && result.Action != gitclone.ActionUpToDate {
+		return exitUpdated
+	}
+
 	return exitOK
 }
 
 func renderError(err error, stdout, stderr io.Writer) int {
-	var cliErr *cliError
-	if !errors.As(err, &cliErr) {
-		cliErr = &cliError{
-			code:    exitFatal,
-			prefix:  "fatal",
-			message: err.Error(),
-		}
-	}
-
+	cliErr := asCLIError(err)
 	if cliErr.help {
 		writeUsage(stdout)
 		return cliErr.code
@@ -259,6 +317,25 @@ func renderError(err error, stdout, stderr io.Writer) int {
 	return cliErr.code
 }
 
+// asCLIError treats errors that did not come with an exit code as fatal.
+func asCLIError(err error) *cliError {
+	var cliErr *cliError
+	if errors.As(err, &cliErr) {
+		return cliErr
+	}
+
+	var gitErr *gitclone.Error
+	if errors.As(err, &gitErr) {
+		return &cliError{code: gitErr.Code, prefix: "fatal", message: gitErr.Message}
+	}
+
+	return &cliError{
+		code:    exitFatal,
+		prefix:  "fatal",
+		message: err.Error(),
+	}
+}
+
 func writeUsage(w io.Writer) {
 	_, _ = io.WriteString(w, cloneUsage)
 }
@@ -346,8 +423,28 @@ func newCloneFlagSet(raw *rawOptions) *pflag.FlagSet {
 	fs.StringVar(&raw.bundleURI, "bundle-uri", "", "")
 
 	addPresenceFlag(fs, &raw.pull, "pull", "", "")
+	fs.StringVar(&raw.pullMode, "pull-mode", "", "")
+	addPresenceFlag(fs, &raw.autostash, "autostash", "", "")
+	addPresenceFlag(fs, &raw.noAutostash, "no-autostash", "", "")
+	addPresenceFlag(fs, &raw.reset, "reset", "", "")
+	addPresenceFlag(fs, &raw.clean, "clean", "", "")
+	addPresenceFlag(fs, &raw.setURL, "set-url", "", "")
+	addPresenceFlag(fs, &raw.prune, "prune", "", "")
+	addPresenceFlag(fs, &raw.noPrune, "no-prune", "", "")
+	addPresenceFlag(fs, &raw.pruneTags, "prune-tags", "", "")
+	addPresenceFlag(fs, &raw.noPruneTags, "no-prune-tags", "", "")
+	fs.IntVar(&raw.deepen, "deepen", 0, "")
+	addPresenceFlag(fs, &raw.unshallow, "unshallow", "", "")
+	addPresenceFlag(fs, &raw.exitCode, "exit-code", "", "")
 	addPresenceFlag(fs, &raw.last, "last", "", "")
+	fs.StringVar(&raw.lastFormat, "last-format", "", "")
+	fs.StringVar(&raw.output, "output", "", "")
+	fs.StringVar(&raw.progressFormat, "progress-format", "", "")
+	addPresenceFlag(fs, &raw.stats, "stats", "", "")
 	fs.StringVar(&raw.identity, "identity", raw.identity, "")
+	fs.StringVar(&raw.timeout, "timeout", "", "")
+	fs.StringVar(&raw.connectTimeout, "connect-timeout", "", "")
+	fs.IntVar(&raw.retries, "retries", 0, "")
 
 	return fs
 }
@@ -473,7 +570,7 @@ func finalizeOptions(raw *rawOptions, positionals []string) (cloneOptions, error
 		}
 	}
 
-	if unsupported := firstUnsupportedFlag(raw.occurrences); unsupported != nil {
+	if unsupported := firstUnsupportedFlag(raw.occurrences, raw.pull); unsupported != nil {
 		return cloneOptions{}, &cliError{
 			code:      exitUsage,
 			prefix:    "error",
@@ -490,6 +587,14 @@ func finalizeOptions(raw *rawOptions, positionals []string) (cloneOptions, error
 		}
 	}
 
+	if raw.retries < 0 {
+		return cloneOptions{}, &cliError{
+			code:    exitFatal,
+			prefix:  "fatal",
+			message: fmt.Sprintf("retries %d is a negative number", raw.retries),
+		}
+	}
+
 	if seen(raw.occurrences, "origin") && raw.origin == "" {
 		return cloneOptions{}, &cliError{
 			code:      exitUsage,
@@ -517,6 +622,14 @@ func finalizeOptions(raw *rawOptions, positionals []string) (cloneOptions, error
 		}
 	}
 
+	if err := validatePullExtensions(raw); err != nil {
+		return cloneOptions{}, err
+	}
+
+	if err := validateShallowUpdate(raw); err != nil {
+		return cloneOptions{}, err
+	}
+
 	recurseSubmodules, recurseOccurrence := resolveOptionalToggle(
 		raw.occurrences,
 		false,
@@ -550,27 +663,103 @@ func finalizeOptions(raw *rawOptions, positionals []string) (cloneOptions, error
 	_ = resolveToggle(raw.occurrences, true, []string{"local"}, []string{"no-local"})
 	_ = resolveToggle(raw.occurrences, true, []string{"hardlinks"}, []string{"no-hardlinks"})
 
+	config, err := gitclone.LoadConfig(plannedGitDir(positionals, bare), positionals[0], configEntries)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+
+	defaults, err := resolveCloneDefaults(config)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+	remoteName := raw.origin
+	if !seen(raw.occurrences, "origin") {
+		remoteName = defaults.remoteName
+	}
+	rejectShallow := resolveToggle(raw.occurrences, defaults.rejectShallow, []string{"reject-shallow"}, []string{"no-reject-shallow"})
+
+	pullMode, pullNoFastForward, err := resolvePullMode(raw, config)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+	autostash, err := resolveAutostash(raw, config, pullMode)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+	prune, noPrune, pruneTags, err := resolvePrune(raw, config, remoteName)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+	shallowSince, err := resolveShallowSince(raw)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+	lastFormat, err := resolveLastFormat(raw)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+	output, err := resolveOutput(raw)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+	progressFormat, err := resolveProgressFormat(raw)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+	timeout, err := resolveTimeout(raw, "timeout", raw.timeout)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+	connectTimeout, err := resolveTimeout(raw, "connect-timeout", raw.connectTimeout)
+	if err != nil {
+		return cloneOptions{}, err
+	}
+
 	return cloneOptions{
-		Repository:        positionals[0],
-		Directory:         positionalDirectory(positionals),
-		RemoteName:        raw.origin,
-		Branch:            raw.branch,
-		Identity:          raw.identity,
-		Depth:             raw.depth,
-		Tags:              boolToTagMode(tags),
-		Checkout:          checkout,
-		Bare:              bare,
-		Mirror:            mirror,
-		Shared:            shared,
-		SingleBranch:      singleBranch,
-		RecurseSubmodules: recurseSubmodules,
-		ShallowSubmodules: shallowSubmodules,
-		Quiet:             quiet,
-		Verbose:           verbose,
-		Progress:          progress,
-		Pull:              raw.pull,
-		Last:              raw.last,
-		ConfigEntries:     configEntries,
+		Options: gitclone.Options{
+			Repository:        positionals[0],
+			Directory:         positionalDirectory(positionals),
+			RemoteName:        remoteName,
+			Branch:            raw.branch,
+			Identity:          raw.identity,
+			Depth:             raw.depth,
+			Tags:              boolToTagMode(tags),
+			NoCheckout:        !checkout,
+			Bare:              bare,
+			Mirror:            mirror,
+			Shared:            shared,
+			RejectShallow:     rejectShallow,
+			SingleBranch:      singleBranch,
+			RecurseSubmodules: recurseSubmodules,
+			ShallowSubmodules: shallowSubmodules,
+			Quiet:             quiet,
+			Verbose:           verbose,
+			Pull:              raw.pull,
+			PullMode:          pullMode,
+			PullNoFastForward: pullNoFastForward,
+			Autostash:         autostash,
+			Reset:             raw.reset,
+			Clean:             raw.clean,
+			SetURL:            raw.setURL,
+			Prune:             prune,
+			NoPrune:           noPrune,
+			PruneTags:         pruneTags,
+			Deepen:            raw.deepen,
+			Unshallow:         raw.unshallow,
+			ShallowSince:      shallowSince,
+			ConfigEntries:     configEntries,
+			Config:            config,
+			Stats:             raw.stats,
+			Timeout:           timeout,
+			ConnectTimeout:    connectTimeout,
+			Retries:           raw.retries,
+		},
+		ProgressMode:   progress,
+		ProgressFormat: progressFormat,
+		ExitCode:       raw.exitCode,
+		Last:           raw.last || seen(raw.occurrences, "last-format"),
+		LastFormat:     lastFormat,
+		Output:         output,
 	}, nil
 }
 
@@ -582,8 +771,297 @@ func positionalDirectory(positionals []string) string {
 	return ""
 }
 
-func parseConfigEntries(rawEntries []string) ([]configEntry, error) {
-	entries := make([]configEntry, 0, len(rawEntries))
+// cloneDefaults are the clone.* settings that change what a flag defaults to
+// when it is not given on the command line.
+type cloneDefaults struct {
+	remoteName    string
+	rejectShallow bool
+}
+
+func resolveCloneDefaults(config *gitclone.Config) (cloneDefaults, error) {
+	defaults := cloneDefaults{remoteName: git.DefaultRemoteName}
+
+	if remoteName, ok := config.Get("clone", "", "defaultRemoteName"); ok && remoteName != "" {
+		defaults.remoteName = remoteName
+	}
+
+	rejectShallow, err := config.GetBool("clone", "", "rejectShallow", false)
+	if err != nil {
+		return cloneDefaults{}, err
+	}
+	defaults.rejectShallow = rejectShallow
+
+	// clone.filterSubmodules only matters together with --filter, which this
+	// build rejects, but a malformed value still fails like it does in git.
+	if _, err := config.GetBool("clone", "", "filterSubmodules", false); err != nil {
+		return cloneDefaults{}, err
+	}
+
+	return defaults, nil
+}
+
+// resolvePullMode picks the --pull strategy: --pull-mode wins, then
+// pull.rebase, then pull.ff. Without any of them only fast-forwards are
+// allowed, which is what --pull always did. The two keys are only taken from
+// -c, so that settings meant for git pull in the user's or repository's
+// config do not change what --pull does.
+func resolvePullMode(raw *rawOptions, config *gitclone.Config) (gitclone.PullMode, bool, error) {
+	if seen(raw.occurrences, "pull-mode") {
+		switch raw.pullMode {
+		case "ff-only":
+			return gitclone.PullFastForwardOnly, false, nil
+		case "rebase":
+			return gitclone.PullRebase, false, nil
+		case "merge":
+			return gitclone.PullMerge, false, nil
+		}
+
+		return 0, false, &cliError{
+			code:      exitUsage,
+			prefix:    "error",
+			message:   fmt.Sprintf("invalid value for --pull-mode: '%s' (expected ff-only, rebase or merge)", raw.pullMode),
+			showUsage: true,
+		}
+	}
+
+	if !raw.pull {
+		return gitclone.PullFastForwardOnly, false, nil
+	}
+
+	config = config.CommandLine()
+	rebase, rebaseSet := config.Get("pull", "", "rebase")
+	if rebaseSet {
+		switch strings.ToLower(strings.TrimSpace(rebase)) {
+		case "merges":
+			return gitclone.PullRebase, false, nil
+		case "interactive", "i":
+			return 0, false, &cliError{
+				code:    exitFatal,
+				prefix:  "fatal",
+				message: "pull.rebase=interactive is not supported by this build of git-clone",
+			}
+		}
+
+		enabled, err := config.GetBool("pull", "", "rebase", false)
+		if err != nil {
+			return 0, false, err
+		}
+		if enabled {
+			return gitclone.PullRebase, false, nil
+		}
+	}
+
+	fastForward, fastForwardSet := config.Get("pull", "", "ff")
+	if fastForwardSet {
+		if strings.EqualFold(strings.TrimSpace(fastForward), "only") {
+			return gitclone.PullFastForwardOnly, false, nil
+		}
+
+		allowed, err := config.GetBool("pull", "", "ff", true)
+		if err != nil {
+			return 0, false, err
+		}
+		return gitclone.PullMerge, !allowed, nil
+	}
+
+	if rebaseSet {
+		return gitclone.PullMerge, false, nil
+	}
+
+	return gitclone.PullFastForwardOnly, false, nil
+}
+
+// resolvePrune applies --[no-]prune and --[no-]prune-tags over
+// remote.<name>.prune(Tags), which in turn override fetch.prune(Tags). It
+// returns prune, noPrune and pruneTags: noPrune records an explicit opt-out,
+// as the library decides itself that bare and mirror repositories prune.
+func resolvePrune(raw *rawOptions, config *gitclone.Config, remoteName string) (bool, bool, bool, error) {
+	if !raw.pull {
+		return false, false, false, nil
+	}
+
+	prune, err := remoteOrFetchBool(config, remoteName, "prune", false)
+	if err != nil {
+		return false, false, false, err
+	}
+	pruneTags, err := remoteOrFetchBool(config, remoteName, "pruneTags", false)
+	if err != nil {
+		return false, false, false, err
+	}
+	_, remoteSet := config.Get("remote", remoteName, "prune")
+	_, fetchSet := config.Get("fetch", "", "prune")
+	explicit := remoteSet || fetchSet || seen(raw.occurrences, "prune") || seen(raw.occurrences, "no-prune")
+
+	prune = resolveToggle(raw.occurrences, prune, []string{"prune"}, []string{"no-prune"})
+	pruneTags = resolveToggle(raw.occurrences, pruneTags, []string{"prune-tags"}, []string{"no-prune-tags"})
+	return prune, explicit && !prune, pruneTags, nil
+}
+
+func remoteOrFetchBool(config *gitclone.Config, remoteName, key string, fallback bool) (bool, error) {
+	if _, ok := config.Get("remote", remoteName, key); ok {
+		return config.GetBool("remote", remoteName, key, fallback)
+	}
+
+	return config.GetBool("fetch", "", key, fallback)
+}
+
+// validatePullExtensions rejects --pull modifiers given without the option
+// they modify.
+func validatePullExtensions(raw *rawOptions) error {
+	requirements := []struct {
+		option   string
+		required string
+		present  bool
+	}{
+		{"pull-mode", "--pull", raw.pull},
+		{"autostash", "--pull", raw.pull},
+		{"no-autostash", "--pull", raw.pull},
+		{"reset", "--pull", raw.pull},
+		{"clean", "--reset", raw.reset},
+		{"set-url", "--pull", raw.pull},
+		{"prune", "--pull", raw.pull},
+		{"no-prune", "--pull", raw.pull},
+		{"prune-tags", "--pull", raw.pull},
+		{"no-prune-tags", "--pull", raw.pull},
+		{"deepen", "--pull", raw.pull},
+		{"unshallow", "--pull", raw.pull},
+		{"exit-code", "--pull", raw.pull},
+	}
+
+	for _, requirement := range requirements {
+		if seen(raw.occurrences, requirement.option) && !requirement.present {
+			return &cliError{
+				code:      exitUsage,
+				prefix:    "error",
+				message:   fmt.Sprintf("option `%s' requires %s", requirement.option, requirement.required),
+				showUsage: true,
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateShallowUpdate checks --deepen, --unshallow and --shallow-since,
+// which each pick a different depth and so exclude one another and --depth.
+func validateShallowUpdate(raw *rawOptions) error {
+	if seen(raw.occurrences, "deepen") && raw.deepen <= 0 {
+		return &cliError{
+			code:    exitFatal,
+			prefix:  "fatal",
+			message: fmt.Sprintf("deepen %d is not a positive number", raw.deepen),
+		}
+	}
+
+	options := []string{"depth", "deepen", "unshallow", "shallow-since"}
+	for i, first := range options {
+		for _, second := range options[i+1:] {
+			if seen(raw.occurrences, first) && seen(raw.occurrences, second) {
+				return &cliError{
+					code:    exitFatal,
+					prefix:  "fatal",
+					message: fmt.Sprintf("options '--%s' and '--%s' cannot be used together", first, second),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveLastFormat parses --last-format, which implies --last.
+func resolveLastFormat(raw *rawOptions) (lastFormat, error) {
+	if !seen(raw.occurrences, "last-format") {
+		return lastFormat{}, nil
+	}
+
+	return parseLastFormat(raw.lastFormat)
+}
+
+func resolveShallowSince(raw *rawOptions) (time.Time, error) {
+	if !seen(raw.occurrences, "shallow-since") {
+		return time.Time{}, nil
+	}
+
+	return parseShallowSince(raw.shallowSince, time.Now())
+}
+
+// resolveTimeout parses --timeout or --connect-timeout: a Go duration such
+// as 30s or 1m30s, or a number of seconds like curl's --max-time. Zero
+// disables the limit.
+func resolveTimeout(raw *rawOptions, name, value string) (time.Duration, error) {
+	if !seen(raw.occurrences, name) {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		var seconds int
+		seconds, err = strconv.Atoi(value)
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if err != nil || timeout < 0 {
+		return 0, &cliError{
+			code:      exitUsage,
+			prefix:    "error",
+			message:   fmt.Sprintf("option `%s' expects a duration such as 30s or 5m, not '%s'", name, value),
+			showUsage: true,
+		}
+	}
+
+	return timeout, nil
+}
+
+// resolveAutostash applies --[no-]autostash over rebase.autoStash or
+// merge.autoStash, whichever matches the pull strategy, like git pull does.
+func resolveAutostash(raw *rawOptions, config *gitclone.Config, mode gitclone.PullMode) (bool, error) {
+	if !raw.pull {
+		return false, nil
+	}
+
+	section := "merge"
+	if mode == gitclone.PullRebase {
+		section = "rebase"
+	}
+	configured, err := config.GetBool(section, "", "autoStash", false)
+	if err != nil {
+		return false, err
+	}
+
+	return resolveToggle(raw.occurrences, configured, []string{"autostash"}, []string{"no-autostash"}), nil
+}
+
+func isBareRepositoryDir(dir string) bool {
+	for _, name := range []string{"HEAD", "config", "objects"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// plannedGitDir is the git directory the clone is going to use, which is what
+// includeIf "gitdir:" conditions are matched against. An existing bare
+// repository at the destination is recognized so that --pull picks up its
+// config even without --bare.
+func plannedGitDir(positionals []string, bare bool) string {
+	destination := gitclone.Destination(positionals[0], positionalDirectory(positionals))
+
+	gitDir, err := filepath.Abs(destination)
+	if err != nil {
+		return ""
+	}
+	if bare || isBareRepositoryDir(gitDir) {
+		return gitDir
+	}
+
+	return filepath.Join(gitDir, ".git")
+}
+
+func parseConfigEntries(rawEntries []string) ([]gitclone.ConfigEntry, error) {
+	entries := make([]gitclone.ConfigEntry, 0, len(rawEntries))
 	for _, raw := range rawEntries {
 		entry, err := parseConfigEntry(raw)
 		if err != nil {
@@ -595,10 +1073,10 @@ func parseConfigEntries(rawEntries []string) ([]configEntry, error) {
 	return entries, nil
 }
 
-func parseConfigEntry(raw string) (configEntry, error) {
+func parseConfigEntry(raw string) (gitclone.ConfigEntry, error) {
 	keyPath, value, hasEquals := strings.Cut(raw, "=")
 	if !hasEquals || keyPath == "" {
-		return configEntry{}, &cliError{
+		return gitclone.ConfigEntry{}, &cliError{
 			code:      exitUsage,
 			prefix:    "error",
 			message:   "option `config' expects `section.key=value' or `section.subsection.key=value'",
@@ -606,30 +1084,9 @@ func parseConfigEntry(raw string) (configEntry, error) {
 		}
 	}
 
-	firstDot := strings.IndexByte(keyPath, '.')
-	if firstDot <= 0 || firstDot == len(keyPath)-1 {
-		return configEntry{}, &cliError{
-			code:      exitUsage,
-			prefix:    "error",
-			message:   fmt.Sprintf("invalid config key `%s`", keyPath),
-			showUsage: true,
-		}
-	}
-
-	lastDot := strings.LastIndexByte(keyPath, '.')
-
-	// section.key (no subsection)
-	if firstDot == lastDot {
-		return configEntry{
-			Section: keyPath[:firstDot],
-			Key:     keyPath[firstDot+1:],
-			Value:   value,
-		}, nil
-	}
-
-	// section.subsection.key
-	if lastDot == len(keyPath)-1 {
-		return configEntry{}, &cliError{
+	section, subsection, key, ok := gitclone.SplitConfigKey(keyPath)
+	if !ok {
+		return gitclone.ConfigEntry{}, &cliError{
 			code:      exitUsage,
 			prefix:    "error",
 			message:   fmt.Sprintf("invalid config key `%s`", keyPath),
@@ -637,10 +1094,10 @@ func parseConfigEntry(raw string) (configEntry, error) {
 		}
 	}
 
-	return configEntry{
-		Section:    keyPath[:firstDot],
-		Subsection: keyPath[firstDot+1 : lastDot],
-		Key:        keyPath[lastDot+1:],
+	return gitclone.ConfigEntry{
+		Section:    section,
+		Subsection: subsection,
+		Key:        key,
 		Value:      value,
 	}, nil
 }
@@ -724,10 +1181,8 @@ func lastOccurrence(occurrences []flagOccurrence, names ...string) *flagOccurren
 	return result
 }
 
-func firstUnsupportedFlag(occurrences []flagOccurrence) *flagOccurrence {
+func firstUnsupportedFlag(occurrences []flagOccurrence, pull bool) *flagOccurrence {
 	unsupported := map[string]struct{}{
-		"reject-shallow":         {},
-		"no-reject-shallow":      {},
 		"jobs":                   {},
 		"no-jobs":                {},
 		"template":               {},
@@ -751,6 +1206,11 @@ func firstUnsupportedFlag(occurrences []flagOccurrence) *flagOccurrence {
 		"bundle-uri":             {},
 	}
 
+	// --shallow-since can only extend an existing shallow clone.
+	if pull {
+		delete(unsupported, "shallow-since")
+	}
+
 	for i := range occurrences {
 		occurrence := &occurrences[i]
 		if _, ok := unsupported[occurrence.name]; ok {
@@ -761,33 +1221,6 @@ func firstUnsupportedFlag(occurrences []flagOccurrence) *flagOccurrence {
 	return nil
 }
 
-func destinationFor(opts cloneOptions) string {
-	if opts.Directory != "" {
-		return opts.Directory
-	}
-
-	endpoint, err := gitEndpointPath(opts.Repository)
-	if err == nil {
-		base := path.Base(endpoint)
-		if base != "." && base != "/" && base != "" {
-			return strings.TrimSuffix(base, ".git")
-		}
-	}
-
-	repository := strings.TrimRight(opts.Repository, "/")
-	base := filepath.Base(repository)
-	return strings.TrimSuffix(base, ".git")
-}
-
-func gitEndpointPath(repository string) (string, error) {
-	endpoint, err := transport.NewEndpoint(repository)
-	if err != nil {
-		return "", err
-	}
-
-	return endpoint.Path, nil
-}
-
 func main() {
 	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/n0madic/git-clone/gitclone"
+)
+
+// runResult is the document --output=json prints once a run finishes.
+type runResult struct {
+	Action      string          `json:"action,omitempty"`
+	Destination string          `json:"destination"`
+	Ref         string          `json:"ref,omitempty"`
+	Commit      string          `json:"commit,omitempty"`
+	Remote      string          `json:"remote"`
+	Depth       int             `json:"depth"`
+	Submodules  int             `json:"submodules"`
+	DurationMS  int64           `json:"duration_ms"`
+	Stats       *gitclone.Stats `json:"stats,omitempty"`
+	Error       *resultError    `json:"error,omitempty"`
+}
+
+type resultError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// resolveOutput validates --output. Its document is the only thing written
+// to stdout, so --last cannot be combined with it; the commit is part of the
+// document anyway.
+func resolveOutput(raw *rawOptions) (string, error) {
+	if !seen(raw.occurrences, "output") {
+		return "", nil
+	}
+	if raw.output != "json" {
+		return "", &cliError{
+			code:      exitUsage,
+			prefix:    "error",
+			message:   fmt.Sprintf("invalid value for --output: '%s' (expected json)", raw.output),
+			showUsage: true,
+		}
+	}
+
+	for _, name := range []string{"last", "last-format"} {
+		if seen(raw.occurrences, name) {
+			return "", &cliError{
+				code:    exitFatal,
+				prefix:  "fatal",
+				message: fmt.Sprintf("options '--output' and '--%s' cannot be used together", name),
+			}
+		}
+	}
+
+	return raw.output, nil
+}
+
+// writeRunResult describes what a run did, or why it failed, as JSON on
+// stdout, with the --stats report when there is one.
+func writeRunResult(stdout io.Writer, opts cloneOptions, result *gitclone.Result, started time.Time, runErr error) error {
+	destination := gitclone.Destination(opts.Config.FetchURL(opts.Repository), opts.Directory)
+	if absolute, err := filepath.Abs(destination); err == nil {
+		destination = absolute
+	}
+
+	document := runResult{
+		Destination: destination,
+		Remote:      gitclone.ScrubURL(opts.Repository),
+		Depth:       opts.Depth,
+		DurationMS:  time.Since(started).Milliseconds(),
+	}
+
+	if runErr != nil {
+		cliErr := asCLIError(runErr)
+		document.Error = &resultError{Code: cliErr.code, Message: cliErr.message}
+	} else {
+		document.Action = result.Action.String()
+		document.Ref = result.Ref
+		if !result.Commit.IsZero() {
+			document.Commit = result.Commit.String()
+		}
+		document.Submodules = result.Submodules
+		document.Stats = result.Stats
+	}
+
+	return json.NewEncoder(stdout).Encode(document)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/n0madic/git-clone/gitclone"
+)
+
+type progressFormat int
+
+const (
+	progressText progressFormat = iota
+	progressJSONL
+)
+
+func resolveProgressFormat(raw *rawOptions) (progressFormat, error) {
+	if !seen(raw.occurrences, "progress-format") {
+		return progressText, nil
+	}
+
+	switch raw.progressFormat {
+	case "text":
+		return progressText, nil
+	case "jsonl":
+		return progressJSONL, nil
+	}
+
+	return 0, &cliError{
+		code:      exitUsage,
+		prefix:    "error",
+		message:   fmt.Sprintf("invalid value for --progress-format: '%s' (expected text or jsonl)", raw.progressFormat),
+		showUsage: true,
+	}
+}
+
+// eventWriter stands in for stderr with --progress-format=jsonl. Everything
+// written to it comes out as one JSON object per line: sideband progress is
+// parsed into progress events and any other line becomes a message event,
+// so the stream stays machine-readable. It is the clone's progress sink
+// only while progress is on; messages are written either way, as they are
+// what stderr would show anyway.
+type eventWriter struct {
+	mu       sync.Mutex
+	out      io.Writer
+	progress bool
+	pending  []byte
+}
+
+type messageEvent struct {
+	Event string `json:"event"`
+	Text  string `json:"text"`
+}
+
+func newEventWriter(out io.Writer, mode progressMode) *eventWriter {
+	return &eventWriter{out: out, progress: mode != progressOff}
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = append(w.pending, p...)
+	for {
+		end := bytes.IndexAny(w.pending, "\r\n")
+		if end < 0 {
+			return len(p), nil
+		}
+		line := string(w.pending[:end])
+		w.pending = w.pending[end+1:]
+		if err := w.writeLine(line); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Flush writes out a final line that was not terminated.
+func (w *eventWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	line := string(w.pending)
+	w.pending = nil
+	return w.writeLine(line)
+}
+
+func (w *eventWriter) writeLine(line string) error {
+	line = strings.TrimRight(line, " ")
+	if line == "" {
+		return nil
+	}
+
+	if event, ok := gitclone.ParseProgressLine(line); ok {
+		if !w.progress {
+			return nil
+		}
+		return w.emit(event)
+	}
+
+	return w.emit(messageEvent{Event: "message", Text: line})
+}
+
+func (w *eventWriter) ReportProgress(event gitclone.ProgressEvent) {
+	w.report(event)
+}
+
+func (w *eventWriter) ReportRef(event gitclone.RefEvent) {
+	w.report(event)
+}
+
+func (w *eventWriter) ReportSubmodule(event gitclone.SubmoduleEvent) {
+	w.report(event)
+}
+
+func (w *eventWriter) report(event any) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_ = w.emit(event)
+}
+
+func (w *eventWriter) emit(event any) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.out.Write(append(data, '\n'))
+	return err
+}
+
+// showProgress decides whether text progress is drawn on stderr.
+func showProgress(mode progressMode, stderr io.Writer) bool {
+	switch mode {
+	case progressForce:
+		return true
+	case progressAuto:
+		return isTerminalWriter(stderr)
+	}
+
+	return false
+}
+
+func isTerminalWriter(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return (info.Mode() & os.ModeCharDevice) != 0
+}
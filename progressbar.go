@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0madic/git-clone/gitclone"
+)
+
+const (
+	// progressBarWidth is the number of cells in the bar itself.
+	progressBarWidth = 20
+	// progressRedrawInterval limits how often a terminal line is redrawn.
+	progressRedrawInterval = 100 * time.Millisecond
+	// progressLineInterval is how often a new line is printed when
+	// --progress forces progress onto something that is not a terminal.
+	progressLineInterval = time.Second
+)
+
+// progressPhases are the phases of a clone in the order they run, with the
+// share of the bar each one fills. go-git resolves deltas while it
+// receives, so that phase only shows up in git's own output.
+var progressPhases = []struct {
+	name   string
+	weight int
+}{
+	{"enumerating-objects", 5},
+	{"counting-objects", 5},
+	{"compressing-objects", 10},
+	{"receiving-objects", 50},
+	{"resolving-deltas", 10},
+	{"checking-out-files", 20},
+}
+
+// progressBar stands in for stderr when text progress is shown. The
+// server's sideband lines and the phases the clone reports are combined
+// into one bar for the whole clone, weighted by progressPhases, next to
+// the running phase with its counts, the transfer rate and an estimate of
+// the time left in it; on a terminal the line is redrawn in place,
+// elsewhere a new line is printed periodically. Any other output is
+// printed above the bar.
+type progressBar struct {
+	mu      sync.Mutex
+	out     io.Writer
+	tty     bool
+	now     func() time.Time
+	pending []byte
+	afterCR bool
+
+	state gitclone.ProgressEvent
+	// step indexes progressPhases for the last known phase, -1 before
+	// one was seen, and percent is how far the bar got so far.
+	step       int
+	percent    int
+	phaseStart time.Time
+	lastDraw   time.Time
+	// drawn is set while an unfinished bar occupies the current terminal
+	// line.
+	drawn bool
+}
+
+func newProgressBar(out io.Writer, tty bool) *progressBar {
+	return &progressBar{out: out, tty: tty, now: time.Now, step: -1}
+}
+
+func (b *progressBar) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, p...)
+	for {
+		end := bytes.IndexAny(b.pending, "\r\n")
+		if end < 0 {
+			return len(p), nil
+		}
+		line, delimiter := string(b.pending[:end]), b.pending[end]
+		b.pending = b.pending[end+1:]
+
+		// Empty sideband updates and the newline of a \r\n pair carry
+		// nothing; empty lines of other output are kept.
+		skip := line == "" && (delimiter == '\r' || b.afterCR)
+		b.afterCR = delimiter == '\r'
+		if skip {
+			continue
+		}
+		if err := b.writeLine(line); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Flush prints an unterminated final line and ends a bar still being
+// drawn.
+func (b *progressBar) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.pending) > 0 {
+		line := string(b.pending)
+		b.pending = nil
+		if err := b.writeLine(line); err != nil {
+			return err
+		}
+	}
+	if b.drawn {
+		b.drawn = false
+		_, err := io.WriteString(b.out, "\n")
+		return err
+	}
+
+	return nil
+}
+
+func (b *progressBar) ReportProgress(event gitclone.ProgressEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_ = b.update(event)
+}
+
+// ReportRef and ReportSubmodule have nothing to draw; what git prints about
+// refs and submodules arrives through Write.
+func (b *progressBar) ReportRef(gitclone.RefEvent) {}
+
+func (b *progressBar) ReportSubmodule(gitclone.SubmoduleEvent) {}
+
+func (b *progressBar) writeLine(line string) error {
+	if event, ok := gitclone.ParseProgressLine(strings.TrimRight(line, " ")); ok {
+		return b.update(event)
+	}
+
+	if b.drawn {
+		if _, err := io.WriteString(b.out, "\r\x1b[K"); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(b.out, line+"\n"); err != nil {
+		return err
+	}
+	if b.drawn {
+		return b.draw()
+	}
+
+	return nil
+}
+
+func (b *progressBar) update(event gitclone.ProgressEvent) error {
+	now := b.now()
+	newPhase := event.Phase != b.state.Phase
+	if newPhase {
+		b.phaseStart = now
+		if step := progressStep(event.Phase); step >= 0 {
+			// A phase that runs before the current one starts another
+			// fetch, of a submodule for example.
+			if step < b.step {
+				b.percent = 0
+			}
+			b.step = step
+		}
+	}
+	b.state = event
+	b.percent = max(b.percent, b.overallPercent())
+
+	interval := progressLineInterval
+	if b.tty {
+		interval = progressRedrawInterval
+	}
+	if !newPhase && !event.Done && now.Sub(b.lastDraw) < interval {
+		return nil
+	}
+	b.lastDraw = now
+
+	if !b.tty {
+		_, err := io.WriteString(b.out, b.render(now)+"\n")
+		return err
+	}
+	if err := b.draw(); err != nil {
+		return err
+	}
+	if b.percent == 100 {
+		b.drawn = false
+		_, err := io.WriteString(b.out, "\n")
+		return err
+	}
+
+	return nil
+}
+
+func (b *progressBar) draw() error {
+	b.drawn = true
+	_, err := io.WriteString(b.out, "\r"+b.render(b.now())+"\x1b[K")
+	return err
+}
+
+// overallPercent is how far the clone is: the phases before the current
+// one count in full and the current one by its own progress. Phases
+// without a total, like receiving objects, only count once they are done.
+func (b *progressBar) overallPercent() int {
+	if b.step < 0 {
+		return 0
+	}
+
+	percent := 0
+	for _, phase := range progressPhases[:b.step] {
+		percent += phase.weight
+	}
+	if b.state.Phase != progressPhases[b.step].name {
+		return percent
+	}
+
+	weight := progressPhases[b.step].weight
+	switch {
+	case b.state.Done:
+		percent += weight
+	case b.state.Total > 0:
+		percent += weight * min(b.state.Percent, 100) / 100
+	}
+
+	return percent
+}
+
+// progressStep finds phase in progressPhases, -1 for phases it does not
+// list.
+func progressStep(phase string) int {
+	for i, known := range progressPhases {
+		if known.name == phase {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// render formats the bar and the current phase, for example
+// "Checking out files:  89% [#################   ] 450/1000, ETA 0:05".
+func (b *progressBar) render(now time.Time) string {
+	event := b.state
+	label := strings.ReplaceAll(event.Phase, "-", " ")
+	if label != "" {
+		label = strings.ToUpper(label[:1]) + label[1:]
+	}
+
+	var line strings.Builder
+	filled := b.percent * progressBarWidth / 100
+	fmt.Fprintf(&line, "%s: %3d%% [%s%s]", label, b.percent,
+		strings.Repeat("#", filled), strings.Repeat(" ", progressBarWidth-filled))
+	switch {
+	case event.Total > 0:
+		fmt.Fprintf(&line, " %d/%d", event.Current, event.Total)
+	case event.Current > 0:
+		fmt.Fprintf(&line, " %d", event.Current)
+	}
+	if event.Bytes > 0 {
+		if event.Current > 0 || event.Total > 0 {
+			line.WriteString(",")
+		}
+		line.WriteString(" " + formatByteSize(event.Bytes))
+		if event.Throughput > 0 {
+			line.WriteString(" | " + formatByteSize(event.Throughput) + "/s")
+		}
+	}
+
+	if b.percent == 100 {
+		line.WriteString(", done.")
+	} else if eta, ok := estimateRemaining(event, now.Sub(b.phaseStart)); ok {
+		fmt.Fprintf(&line, ", ETA %d:%02d", int(eta.Minutes()), int(eta.Seconds())%60)
+	}
+
+	return line.String()
+}
+
+// estimateRemaining extrapolates the rate of the running phase. Phases
+// without a known total, like receiving objects, and those about to end
+// have no estimate.
+func estimateRemaining(event gitclone.ProgressEvent, elapsed time.Duration) (time.Duration, bool) {
+	if event.Total == 0 || event.Current == 0 || event.Current >= event.Total || elapsed <= 0 {
+		return 0, false
+	}
+
+	remaining := time.Duration(float64(elapsed) * float64(event.Total-event.Current) / float64(event.Current)).Round(time.Second)
+	return remaining, remaining > 0
+}
+
+// formatByteSize is the inverse of parseByteSize, using git's units.
+func formatByteSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.2f GiB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.2f KiB", float64(size)/(1<<10))
+	}
+
+	return fmt.Sprintf("%d bytes", size)
+}
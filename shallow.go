@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var relativeDatePattern = regexp.MustCompile(`^(\d+)\s*\.?\s*(second|minute|hour|day|week|month|year)s?\s+ago$`)
+
+// parseShallowSince accepts the --shallow-since forms scripts use: ISO 8601
+// dates with or without a time, RFC 2822 dates, @<unix timestamp> and
+// relative dates such as "2 weeks ago".
+func parseShallowSince(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if strings.HasPrefix(value, "@") {
+		if seconds, err := strconv.ParseInt(value[1:], 10, 64); err == nil {
+			return time.Unix(seconds, 0), nil
+		}
+	}
+
+	if match := relativeDatePattern.FindStringSubmatch(strings.ToLower(value)); match != nil {
+		count, err := strconv.Atoi(match[1])
+		if err == nil {
+			switch match[2] {
+			case "second":
+				return now.Add(-time.Duration(count) * time.Second), nil
+			case "minute":
+				return now.Add(-time.Duration(count) * time.Minute), nil
+			case "hour":
+				return now.Add(-time.Duration(count) * time.Hour), nil
+			case "day":
+				return now.AddDate(0, 0, -count), nil
+			case "week":
+				return now.AddDate(0, 0, -7*count), nil
+			case "month":
+				return now.AddDate(0, -count, 0), nil
+			case "year":
+				return now.AddDate(-count, 0, 0), nil
+			}
+		}
+	}
+
+	for _, layout := range []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05 -0700",
+		"2006-01-02 15:04:05",
+		"2006-01-02",
+		time.RFC1123Z,
+		"Mon Jan 2 15:04:05 2006 -0700",
+	} {
+		if parsed, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, &cliError{
+		code:    exitFatal,
+		prefix:  "fatal",
+		message: fmt.Sprintf("invalid date format: %s", value),
+	}
+}
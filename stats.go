@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/n0madic/git-clone/gitclone"
+)
+
+type statsEvent struct {
+	Event string `json:"event"`
+	gitclone.Stats
+}
+
+// writeStats prints report on stderr, as a "stats" event when stderr is a
+// JSON-lines stream. It was asked for, so it is printed even when progress
+// is off.
+func writeStats(stderr io.Writer, report *gitclone.Stats) error {
+	if w, ok := stderr.(*eventWriter); ok {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.emit(statsEvent{Event: "stats", Stats: *report})
+	}
+
+	var out strings.Builder
+	fmt.Fprintln(&out, "Statistics:")
+	fmt.Fprintf(&out, "  refs advertised:   %d\n", report.RefsAdvertised)
+	fmt.Fprintf(&out, "  objects received:  %d\n", report.ObjectsReceived)
+	fmt.Fprintf(&out, "  pack size:         %s\n", formatByteSize(report.PackBytes))
+	fmt.Fprintf(&out, "  files checked out: %d\n", report.FilesCheckedOut)
+	files := "files"
+	if report.WorktreeFiles == 1 {
+		files = "file"
+	}
+	fmt.Fprintf(&out, "  worktree:          %d %s, %s\n", report.WorktreeFiles, files, formatByteSize(report.WorktreeBytes))
+	fmt.Fprintf(&out, "  submodules:        %d (%d updated)\n", report.Submodules, report.SubmodulesUpdated)
+	for _, phase := range report.Phases {
+		fmt.Fprintf(&out, "  %-18s %.3f s\n", phase.Name+":", phase.DurationMS/1000)
+	}
+	fmt.Fprintf(&out, "  %-18s %.3f s\n", "total:", report.DurationMS/1000)
+
+	_, err := io.WriteString(stderr, out.String())
+	return err
+}